@@ -13,6 +13,7 @@ import (
 	"github.com/alecholmes/spotlight/app/notifiers"
 	"github.com/alecholmes/spotlight/app/oauth"
 	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/signing"
 	"github.com/alecholmes/spotlight/spotify"
 
 	"github.com/braintree/manners"
@@ -52,32 +53,57 @@ func (a *App) Run(stopCh <-chan struct{}) {
 	}
 	defer stopDB()
 
-	store := model.NewDBStore(db)
-	sessions, err := requests.NewSessions(a.config.HTTPSession)
+	keyRing, err := model.NewKeyRing(a.config.TokenEncryption)
+	if err != nil {
+		glog.Errorf("Error initializing token encryption: %v", err)
+		return
+	}
+
+	store := model.NewDBStore(db, keyRing)
+	sessions, err := requests.NewSessions(a.config.HTTPSession, store)
 	if err != nil {
 		glog.Errorf("Error initializing HTTP sessions: %v", err)
 		return
 	}
 
+	signer, err := signing.NewSigner(a.config.Signing)
+	if err != nil {
+		glog.Errorf("Error initializing signer: %v", err)
+		return
+	}
+
 	// Create notifier
 	mailer := notifiers.NewMailerFromConfig(a.config.Email)
-	notifier := notifiers.NewNotifier(a.config.AppBaseURL, a.config.AppEmail, mailer)
+	notifier := notifiers.NewNotifier(a.config.AppBaseURL, a.config.AppEmail, mailer, signer)
 
 	// Create controllers
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(controllers.Render404)
 
-	oauth := oauth.NewOAuth(oauth.SpotifyConfig(a.config.AppBaseURL, a.config.OAuth, requiredScopes), sessions, store, controllers.Render500)
+	// Token manager is shared by controllers and jobs so refreshes are never duplicated
+	oauthConfig := oauth.SpotifyConfig(a.config.AppBaseURL, a.config.OAuth, requiredScopes)
+	tokenManager := oauth.NewTokenManager(oauthConfig, store)
+
+	oauth, err := oauth.NewOAuth(oauthConfig, tokenManager, a.config.AppBaseURL, sessions, store, controllers.Render500)
+	if err != nil {
+		glog.Errorf("Error initializing OAuth: %v", err)
+		return
+	}
 	oauth.BindToMux(router)
 
-	controllers.NewHome(sessions).BindToMux(router, oauth, controllers.Render500)
+	csrf := requests.NewCSRF(sessions, controllers.Render500)
+
+	controllers.NewHome(sessions, csrf).BindToMux(router, oauth, controllers.Render500)
 
 	spotifyClientFn := func(user *model.User) (*spotify.SpotifyClient, error) { return newSpotifyClient(oauth, user) }
 	controllers.NewSubscriptionsController(
-		oauth, spotifyClientFn, store, notifier, controllers.Render500).
+		oauth, csrf, spotifyClientFn, store, store, store, notifier, signer, controllers.Render500).
 		BindToMux(router)
 
-	controllers.NewPlaylistsController(oauth, spotifyClientFn, store, controllers.Render500).
+	controllers.NewPlaylistsController(oauth, csrf, spotifyClientFn, store, controllers.Render500).
+		BindToMux(router)
+
+	controllers.NewAccountController(oauth, csrf, sessions, tokenManager, store, store, store, controllers.Render500).
 		BindToMux(router)
 
 	// Serve HTTP endpoints
@@ -90,9 +116,30 @@ func (a *App) Run(stopCh <-chan struct{}) {
 
 	// Start jobs
 	glog.Info("Initializing jobs")
-	stopUpdatePlaylistJob := a.initUpdatePlaylistJob(oauth, store, store, notifier)
+	updatePlaylistsJob := jobs.NewUpdatePlaylistsJob(oauth, store, store, notifier)
+	stopUpdatePlaylistJob := a.initJob("update playlists", 10*time.Second, updatePlaylistsJob.Run)
 	defer stopUpdatePlaylistJob()
 
+	notifyReauthJob := jobs.NewNotifyReauthJob(store, notifier)
+	stopNotifyReauthJob := a.initJob("notify re-authorization", time.Minute, notifyReauthJob.Run)
+	defer stopNotifyReauthJob()
+
+	reencryptTokensJob := jobs.NewReencryptTokensJob(store)
+	stopReencryptTokensJob := a.initJob("re-encrypt tokens", time.Hour, reencryptTokensJob.Run)
+	defer stopReencryptTokensJob()
+
+	expireSessionsJob := jobs.NewExpireSessionsJob(store)
+	stopExpireSessionsJob := a.initJob("expire sessions", time.Hour, expireSessionsJob.Run)
+	defer stopExpireSessionsJob()
+
+	refreshProfilesJob := jobs.NewRefreshProfilesJob(oauth, store)
+	stopRefreshProfilesJob := a.initJob("refresh profiles", 10*time.Minute, refreshProfilesJob.Run)
+	defer stopRefreshProfilesJob()
+
+	reconcileFollowsJob := jobs.NewReconcileFollowsJob(oauth, store, store)
+	stopReconcileFollowsJob := a.initJob("reconcile follows", 10*time.Minute, reconcileFollowsJob.Run)
+	defer stopReconcileFollowsJob()
+
 	// Wait for the app to stop or a fatal HTTP error to occur
 	select {
 	case <-stopCh:
@@ -136,22 +183,20 @@ func (a *App) initHTTP(port int, router http.Handler) (func(), <-chan error, err
 	}, errCh, nil
 }
 
-func (a *App) initUpdatePlaylistJob(oauth *oauth.OAuth, userStore model.UserStore,
-	playlistStore model.PlaylistStore, notifier *notifiers.Notifier) func() {
-
+// initJob runs fn every period until the returned function is called.
+func (a *App) initJob(name string, period time.Duration, fn func() error) func() {
 	stopCh := make(chan struct{})
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	job := jobs.NewUpdatePlaylistsJob(oauth, userStore, playlistStore, notifier)
 	go func() {
 		for done := false; !done; {
-			next := time.After(10 * time.Second)
+			next := time.After(period)
 			select {
 			case <-next:
-				if err := job.Run(); err != nil {
-					glog.Errorf("Error updating playlists. %v", err)
+				if err := fn(); err != nil {
+					glog.Errorf("Error running %s job. %v", name, err)
 				}
 			case <-stopCh:
 				done = true
@@ -162,7 +207,7 @@ func (a *App) initUpdatePlaylistJob(oauth *oauth.OAuth, userStore model.UserStor
 	}()
 
 	return func() {
-		glog.Info("Shutting down update playlist job")
+		glog.Infof("Shutting down %s job", name)
 		close(stopCh)
 		wg.Wait()
 	}
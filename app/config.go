@@ -8,6 +8,7 @@ import (
 	"github.com/alecholmes/spotlight/app/notifiers"
 	"github.com/alecholmes/spotlight/app/oauth"
 	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/signing"
 
 	"github.com/go-errors/errors"
 	yaml "gopkg.in/yaml.v2"
@@ -18,13 +19,15 @@ type HTTPServerConfig struct {
 }
 
 type AppConfig struct {
-	AppBaseURL  string                  `yaml:"app_base_url"`
-	AppEmail    string                  `yaml:"app_email"`
-	Database    *model.DBConfig         `yaml:"database"`
-	Email       *notifiers.MailerConfig `yaml:"email"`
-	HTTPServer  *HTTPServerConfig       `yaml:"http_server"`
-	HTTPSession *requests.SessionConfig `yaml:"http_session"`
-	OAuth       *oauth.Config           `yaml:"oauth"`
+	AppBaseURL      string                  `yaml:"app_base_url"`
+	AppEmail        string                  `yaml:"app_email"`
+	Database        *model.DBConfig         `yaml:"database"`
+	Email           *notifiers.MailerConfig `yaml:"email"`
+	HTTPServer      *HTTPServerConfig       `yaml:"http_server"`
+	HTTPSession     *requests.SessionConfig `yaml:"http_session"`
+	OAuth           *oauth.Config           `yaml:"oauth"`
+	Signing         *signing.Config         `yaml:"signing"`
+	TokenEncryption *model.EncryptionConfig `yaml:"token_encryption"`
 }
 
 func ParseConfig(filename string) (*AppConfig, error) {
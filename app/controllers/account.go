@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/oauth"
+	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/templates"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+const exportActivityPageSize = 500
+
+// AccountExport is everything stored about a user, minus secrets such as OAuth tokens.
+type AccountExport struct {
+	ExportedAt     time.Time                `json:"exportedAt"`
+	User           *ExportedUser            `json:"user"`
+	ProfileChanges []*ExportedProfileChange `json:"profileChanges"`
+	Subscriptions  []*ExportedSubscription  `json:"subscriptions"`
+	Activities     []*ExportedActivity      `json:"activities"`
+}
+
+type ExportedUser struct {
+	ID        model.UserID `json:"id"`
+	Name      string       `json:"name"`
+	Email     string       `json:"email"`
+	CreatedAt time.Time    `json:"createdAt"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+type ExportedProfileChange struct {
+	Field     model.ProfileField `json:"field"`
+	OldValue  string             `json:"oldValue"`
+	NewValue  string             `json:"newValue"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+type ExportedSubscription struct {
+	Token              model.SubscriptionToken  `json:"token"`
+	PlaylistID         model.PlaylistID         `json:"playlistId"`
+	PlaylistOwnerID    model.UserID             `json:"playlistOwnerId"`
+	PlaylistName       string                   `json:"playlistName"`
+	Status             model.SubscriptionStatus `json:"status"`
+	SnoozedUntil       *time.Time               `json:"snoozedUntil"`
+	NotificationFilter model.NotificationFilter `json:"notificationFilter"`
+	TrackIDs           []string                 `json:"trackIds"`
+	CreatedAt          time.Time                `json:"createdAt"`
+	UpdatedAt          time.Time                `json:"updatedAt"`
+}
+
+type ExportedActivity struct {
+	ID                model.ActivityID        `json:"id"`
+	SubscriptionToken model.SubscriptionToken `json:"subscriptionToken"`
+	Data              *model.ActivityData     `json:"data"`
+	CreatedAt         time.Time               `json:"createdAt"`
+}
+
+type Account struct {
+	oauth         *oauth.OAuth
+	csrf          *requests.CSRF
+	sessions      *requests.Sessions
+	tokens        *oauth.TokenManager
+	userStore     model.UserStore
+	playlistStore model.PlaylistStore
+	sessionStore  model.SessionStore
+	errorHandler  func(http.ResponseWriter, error)
+	clock         util.Clock
+}
+
+func NewAccountController(
+	oauth *oauth.OAuth,
+	csrf *requests.CSRF,
+	sessions *requests.Sessions,
+	tokens *oauth.TokenManager,
+	userStore model.UserStore,
+	playlistStore model.PlaylistStore,
+	sessionStore model.SessionStore,
+	errorHandler func(http.ResponseWriter, error)) *Account {
+
+	return &Account{
+		oauth:         oauth,
+		csrf:          csrf,
+		sessions:      sessions,
+		tokens:        tokens,
+		userStore:     userStore,
+		playlistStore: playlistStore,
+		sessionStore:  sessionStore,
+		errorHandler:  errorHandler,
+		clock:         util.WallClock,
+	}
+}
+
+func (a *Account) BindToMux(mux *mux.Router) {
+	mux.HandleFunc("/account",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.View, a.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/account/settings",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.UpdateSettings, a.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/account/sessions/revoke",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.RevokeSession, a.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/account/sessions/revoke-all",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.RevokeAllSessions, a.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/account/export",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.Export, a.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/account/delete",
+		requests.WithContext(a.csrf.Protect(a.oauth.MustBeAuthed(a.Delete, a.errorHandler)))).
+		Methods(http.MethodPost)
+}
+
+func (a *Account) View(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	session, err := a.sessions.GetSession(req)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	userSessions, err := a.sessionStore.ListSessionsForUser(user.ID)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	templatedSessions := make([]*templates.Session, len(userSessions))
+	for i, userSession := range userSessions {
+		templatedSessions[i] = templates.NewSession(userSession, session.ID())
+	}
+
+	data := &templates.AccountViewData{
+		LayoutData:      newLayoutData(req),
+		Name:            user.Name,
+		Email:           user.Email,
+		AutoSubscribe:   user.AutoSubscribe,
+		AutoUnsubscribe: user.AutoUnsubscribe,
+		Sessions:        templatedSessions,
+	}
+
+	if err := templates.AccountView.Execute(rw, data); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+// UpdateSettings saves whether the user is automatically subscribed to and unsubscribed from playlists
+// as they follow and unfollow them in Spotify.
+func (a *Account) UpdateSettings(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	autoSubscribe := req.FormValue("autoSubscribe") == "true"
+	autoUnsubscribe := req.FormValue("autoUnsubscribe") == "true"
+	if err := a.userStore.UpdateSubscriptionSettings(user.ID, autoSubscribe, autoUnsubscribe); err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+	glog.Infof("Updated subscription settings. userID=`%s` autoSubscribe=%t autoUnsubscribe=%t", user.ID, autoSubscribe, autoUnsubscribe)
+
+	rw.Header().Set("Location", "/account")
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (a *Account) RevokeSession(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+	sessionID := model.SessionID(req.FormValue("id"))
+
+	session, err := a.sessions.GetSession(req)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	// Only allow revoking the user's own sessions
+	userSessions, err := a.sessionStore.ListSessionsForUser(user.ID)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	found := false
+	for _, userSession := range userSessions {
+		found = found || userSession.ID == sessionID
+	}
+
+	location := "/account"
+	if !found {
+		glog.Infof("Attempt to revoke session that does not exist. userID=`%s`", user.ID)
+	} else if sessionID == session.ID() {
+		session.Delete(req, rw)
+		location = "/"
+	} else if err := a.sessionStore.DeleteSession(sessionID); err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	rw.Header().Set("Location", location)
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (a *Account) RevokeAllSessions(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	session, err := a.sessions.GetSession(req)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	count, err := a.sessionStore.DeleteSessionsForUser(user.ID)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+	glog.Infof("Revoked all sessions. userID=`%s` count=%d", user.ID, count)
+
+	session.Delete(req, rw)
+
+	rw.Header().Set("Location", "/")
+	rw.WriteHeader(http.StatusFound)
+}
+
+// Export downloads a JSON document of the user's account, subscriptions and activities.
+func (a *Account) Export(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	profileChanges, err := a.userStore.ListProfileChanges(user.ID)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	subs, err := a.playlistStore.ListSubscriptionsForUser(user.ID)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	export := &AccountExport{
+		ExportedAt: a.clock.Now(),
+		User: &ExportedUser{
+			ID:        user.ID,
+			Name:      user.Name,
+			Email:     user.Email,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+		},
+		ProfileChanges: make([]*ExportedProfileChange, len(profileChanges)),
+		Subscriptions:  make([]*ExportedSubscription, len(subs)),
+		Activities:     []*ExportedActivity{},
+	}
+
+	for i, change := range profileChanges {
+		export.ProfileChanges[i] = &ExportedProfileChange{
+			Field:     change.Field,
+			OldValue:  change.OldValue,
+			NewValue:  change.NewValue,
+			CreatedAt: change.CreatedAt,
+		}
+	}
+
+	for i, sub := range subs {
+		_, tracks, err := a.playlistStore.GetPlaylist(sub.PlaylistID, sub.PlaylistVersion)
+		if err != nil {
+			a.errorHandler(rw, err)
+			return
+		}
+
+		trackIDs := make([]string, len(tracks))
+		for j, track := range tracks {
+			trackIDs[j] = track.TrackID
+		}
+
+		export.Subscriptions[i] = &ExportedSubscription{
+			Token:              sub.Token,
+			PlaylistID:         sub.PlaylistID,
+			PlaylistOwnerID:    sub.PlaylistOwnerID,
+			PlaylistName:       sub.PlaylistName,
+			Status:             sub.Status,
+			SnoozedUntil:       sub.SnoozedUntil,
+			NotificationFilter: sub.NotificationFilter,
+			TrackIDs:           trackIDs,
+			CreatedAt:          sub.CreatedAt,
+			UpdatedAt:          sub.UpdatedAt,
+		}
+	}
+
+	to := model.LatestActivityID
+	for {
+		activities, err := a.playlistStore.ListActivityForUser(user.ID, to, exportActivityPageSize)
+		if err != nil {
+			a.errorHandler(rw, err)
+			return
+		}
+
+		for _, activity := range activities {
+			export.Activities = append(export.Activities, &ExportedActivity{
+				ID:                activity.ID,
+				SubscriptionToken: activity.SubscriptionToken,
+				Data:              activity.Data,
+				CreatedAt:         activity.CreatedAt,
+			})
+		}
+
+		if len(activities) < exportActivityPageSize {
+			break
+		}
+		to = activities[len(activities)-1].ID - 1
+	}
+
+	body, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	filename := fmt.Sprintf("spotlight-export-%s.json", export.ExportedAt.Format("2006-01-02"))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	rw.Write(body)
+}
+
+// Delete permanently removes the user's account and signs them out everywhere.
+func (a *Account) Delete(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	session, err := a.sessions.GetSession(req)
+	if err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+
+	if _, err := a.userStore.DeleteUser(user.ID); err != nil {
+		a.errorHandler(rw, err)
+		return
+	}
+	a.tokens.Forget(user.ID)
+	glog.Infof("Deleted account. userID=`%s`", user.ID)
+
+	session.Delete(req, rw)
+
+	rw.Header().Set("Location", "/")
+	rw.WriteHeader(http.StatusFound)
+}
@@ -13,20 +13,21 @@ import (
 
 type Home struct {
 	sessions *requests.Sessions
+	csrf     *requests.CSRF
 }
 
-func NewHome(sessions *requests.Sessions) *Home {
-	return &Home{sessions: sessions}
+func NewHome(sessions *requests.Sessions, csrf *requests.CSRF) *Home {
+	return &Home{sessions: sessions, csrf: csrf}
 }
 
 func (h *Home) BindToMux(mux *mux.Router, oauth *oauth.OAuth, errorHandler func(http.ResponseWriter, error)) {
 	mux.HandleFunc("/",
-		requests.WithContext(oauth.OptionallyAuthed(h.View, errorHandler))).
+		requests.WithContext(h.csrf.Protect(oauth.OptionallyAuthed(h.View, errorHandler)))).
 		Methods(http.MethodGet)
 
 	mux.HandleFunc("/logout",
-		requests.WithContext(h.Logout)).
-		Methods(http.MethodGet)
+		requests.WithContext(h.csrf.Protect(h.Logout))).
+		Methods(http.MethodPost)
 }
 
 func (h *Home) View(rw http.ResponseWriter, req *http.Request) {
@@ -37,7 +38,7 @@ func (h *Home) View(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := templates.HomeView.Execute(rw, &templates.LayoutData{SignedIn: false}); err != nil {
+	if err := templates.HomeView.Execute(rw, &templates.LayoutData{CSRFToken: requests.CSRFTokenFromContext(req.Context())}); err != nil {
 		glog.Errorf("Unable to render template: %v", err)
 	}
 }
@@ -2,25 +2,80 @@ package controllers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/alecholmes/spotlight/app/jobs"
 	"github.com/alecholmes/spotlight/app/model"
 	"github.com/alecholmes/spotlight/app/oauth"
 	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/templates"
 	"github.com/alecholmes/spotlight/spotify"
 	"github.com/alecholmes/spotlight/util"
 
+	"github.com/go-errors/errors"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
+const (
+	playlistStatsLimit = 10
+)
+
 type CreatePlaylistRequest struct {
-	PlaylistName string `json:"playlist_name`
+	PlaylistName string `json:"playlistName"`
+}
+
+type PlaylistSnapshotResponse struct {
+	SnapshotID    string                   `json:"snapshotId"`
+	Name          string                   `json:"name"`
+	Description   string                   `json:"description"`
+	Collaborative bool                     `json:"collaborative"`
+	CreatedAt     time.Time                `json:"createdAt"`
+	Tracks        []*PlaylistTrackResponse `json:"tracks,omitempty"`
+}
+
+type PlaylistTrackResponse struct {
+	Position    int          `json:"position"`
+	TrackID     string       `json:"trackId"`
+	Name        string       `json:"name,omitempty"`
+	ArtistNames []string     `json:"artistNames,omitempty"`
+	AlbumName   string       `json:"albumName,omitempty"`
+	URI         string       `json:"uri,omitempty"`
+	AddedAt     *time.Time   `json:"addedAt,omitempty"`
+	AddedBy     model.UserID `json:"addedBy,omitempty"`
+}
+
+type PlaylistStatsResponse struct {
+	TrackCount       int                    `json:"trackCount"`
+	ContributorCount int                    `json:"contributorCount"`
+	Contributors     []*StatCountResponse   `json:"contributors"`
+	TopArtists       []*StatCountResponse   `json:"topArtists"`
+	TopAlbums        []*StatCountResponse   `json:"topAlbums"`
+	WeeklyTracks     []*WeeklyCountResponse `json:"weeklyTracks"`
+}
+
+type StatCountResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type WeeklyCountResponse struct {
+	WeekOf string `json:"weekOf"`
+	Count  int    `json:"count"`
+}
+
+type PlaylistDiffResponse struct {
+	From    *PlaylistSnapshotResponse `json:"from"`
+	To      *PlaylistSnapshotResponse `json:"to"`
+	Added   []*PlaylistTrackResponse  `json:"added"`
+	Removed []*PlaylistTrackResponse  `json:"removed"`
 }
 
 type Playlists struct {
 	oauth           *oauth.OAuth
+	csrf            *requests.CSRF
 	spotifyClientFn func(user *model.User) (*spotify.SpotifyClient, error)
 	playlistStore   model.PlaylistStore
 	errorHandler    func(http.ResponseWriter, error)
@@ -29,12 +84,14 @@ type Playlists struct {
 
 func NewPlaylistsController(
 	oauth *oauth.OAuth,
+	csrf *requests.CSRF,
 	spotifyClientFn func(user *model.User) (*spotify.SpotifyClient, error),
 	playlistStore model.PlaylistStore,
 	errorHandler func(http.ResponseWriter, error)) *Playlists {
 
 	return &Playlists{
 		oauth:           oauth,
+		csrf:            csrf,
 		spotifyClientFn: spotifyClientFn,
 		playlistStore:   playlistStore,
 		errorHandler:    errorHandler,
@@ -44,8 +101,28 @@ func NewPlaylistsController(
 
 func (p *Playlists) BindToMux(mux *mux.Router) {
 	mux.HandleFunc("/playlists",
-		requests.WithContext(p.oauth.MustBeAuthed(p.Create, p.errorHandler))).
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.Create, p.errorHandler)))).
 		Methods(http.MethodPost)
+	mux.HandleFunc("/playlists/{id}/history",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.History, p.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/playlists/{id}/history/restore",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.Restore, p.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/playlists/{id}/stats",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.Stats, p.errorHandler)))).
+		Methods(http.MethodGet)
+
+	// REST API for playlist history and stats
+	mux.HandleFunc("/api/playlists/{id}/history",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.HistoryAPI, p.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/api/playlists/{id}/history/diff",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.HistoryDiffAPI, p.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/api/playlists/{id}/stats",
+		requests.WithContext(p.csrf.Protect(p.oauth.MustBeAuthed(p.StatsAPI, p.errorHandler)))).
+		Methods(http.MethodGet)
 }
 
 func (p *Playlists) Create(rw http.ResponseWriter, req *http.Request) {
@@ -80,11 +157,523 @@ func (p *Playlists) Create(rw http.ResponseWriter, req *http.Request) {
 	}
 	glog.Infof("Created playlist. userID=`%s` playlistID=`%s` playlistName=`%s`", user.ID, playlist.ID, playlist.Name)
 
-	sub := newSubscription(user.ID, playlist, p.clock.Now().Add(jobs.SubscriptionCheckPeriod))
-	if _, err := p.playlistStore.CreateSubscription(sub); err != nil {
+	if _, err := jobs.CreateSubscription(p.playlistStore, user.ID, playlist, p.clock.Now().Add(jobs.SubscriptionCheckPeriod)); err != nil {
 		p.errorHandler(rw, err)
 		return
 	}
 
 	rw.Write([]byte(`{}`))
 }
+
+// History shows the playlist as it was at a stored snapshot, optionally compared with another. The snapshot
+// is chosen by ID, or as the latest one stored by a time given with "at".
+func (p *Playlists) History(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, snapshots, err := p.loadHistory(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	} else if sub == nil {
+		Render404(rw, req)
+		return
+	}
+
+	query := req.URL.Query()
+	selected, err := selectSnapshot(sub, snapshots, query.Get("snapshot"), query.Get("at"))
+	if err != nil {
+		glog.Infof("Invalid history request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	} else if selected == nil {
+		Render404(rw, req)
+		return
+	}
+
+	_, tracks, err := p.playlistStore.GetPlaylist(selected.ID, selected.SnapshotID)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	data := &templates.PlaylistHistoryViewData{
+		LayoutData:  newLayoutData(req),
+		PlaylistID:  sub.PlaylistID,
+		CurrentName: sub.PlaylistName,
+		Tracks:      templates.NewHistoryTracks(tracks),
+	}
+
+	compared := findSnapshot(snapshots, query.Get("compare"))
+	if compared != nil {
+		_, comparedTracks, err := p.playlistStore.GetPlaylist(compared.ID, compared.SnapshotID)
+		if err != nil {
+			p.errorHandler(rw, err)
+			return
+		}
+
+		data.Added = templates.NewHistoryTracks(model.AddedPlaylistTracks(tracks, comparedTracks))
+		data.Removed = templates.NewHistoryTracks(model.AddedPlaylistTracks(comparedTracks, tracks))
+	}
+
+	for _, snapshot := range snapshots {
+		templated := templates.NewHistorySnapshot(snapshot)
+		templated.Selected = snapshot == selected
+		templated.Compared = snapshot == compared
+		data.Snapshots = append(data.Snapshots, templated)
+
+		if templated.Selected {
+			data.Selected = templated
+		}
+		if templated.Compared {
+			data.Compared = templated
+		}
+	}
+
+	if err := templates.PlaylistHistoryView.Execute(rw, data); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+// HistoryAPI lists the playlist's stored snapshots, or returns one snapshot with its tracks if it's chosen
+// by "snapshot" or "at" like in History.
+func (p *Playlists) HistoryAPI(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, snapshots, err := p.loadHistory(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	} else if sub == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := req.URL.Query()
+	if len(query.Get("snapshot")) == 0 && len(query.Get("at")) == 0 {
+		resp := make([]*PlaylistSnapshotResponse, len(snapshots))
+		for i, snapshot := range snapshots {
+			resp[i] = newPlaylistSnapshotResponse(snapshot, nil)
+		}
+
+		writeJSON(rw, resp, p.errorHandler)
+		return
+	}
+
+	selected, err := selectSnapshot(sub, snapshots, query.Get("snapshot"), query.Get("at"))
+	if err != nil {
+		glog.Infof("Invalid history request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	} else if selected == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, tracks, err := p.playlistStore.GetPlaylist(selected.ID, selected.SnapshotID)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	writeJSON(rw, newPlaylistSnapshotResponse(selected, tracks), p.errorHandler)
+}
+
+// HistoryDiffAPI returns the tracks added and removed between the "from" and "to" snapshots.
+func (p *Playlists) HistoryDiffAPI(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, snapshots, err := p.loadHistory(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	} else if sub == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	from := findSnapshot(snapshots, req.URL.Query().Get("from"))
+	to := findSnapshot(snapshots, req.URL.Query().Get("to"))
+	if from == nil || to == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, fromTracks, err := p.playlistStore.GetPlaylist(from.ID, from.SnapshotID)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+	_, toTracks, err := p.playlistStore.GetPlaylist(to.ID, to.SnapshotID)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	writeJSON(rw, &PlaylistDiffResponse{
+		From:    newPlaylistSnapshotResponse(from, nil),
+		To:      newPlaylistSnapshotResponse(to, nil),
+		Added:   newPlaylistTrackResponses(model.AddedPlaylistTracks(fromTracks, toTracks)),
+		Removed: newPlaylistTrackResponses(model.AddedPlaylistTracks(toTracks, fromTracks)),
+	}, p.errorHandler)
+}
+
+// Restore brings back a stored snapshot's tracks, either by re-adding the ones that have since been
+// removed from the playlist, or by creating a new playlist with exactly those tracks.
+func (p *Playlists) Restore(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, snapshots, err := p.loadHistory(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	snapshot := findSnapshot(snapshots, req.FormValue("snapshot"))
+	if sub == nil || snapshot == nil {
+		Render404(rw, req)
+		return
+	}
+
+	_, tracks, err := p.playlistStore.GetPlaylist(snapshot.ID, snapshot.SnapshotID)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	client, err := p.spotifyClientFn(user)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	location := fmt.Sprintf("/playlists/%s/history", sub.PlaylistID)
+	switch req.FormValue("mode") {
+	case "readd":
+		err = p.readdTracks(client, sub, tracks)
+	case "recreate":
+		err = p.recreatePlaylist(client, user, snapshot, tracks)
+		location = "/subscriptions"
+	default:
+		glog.Infof("Invalid restore mode. mode=`%s`", req.FormValue("mode"))
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	rw.Header().Set("Location", location)
+	rw.WriteHeader(http.StatusFound)
+}
+
+// readdTracks adds tracks from a snapshot that aren't in the playlist now. Tracks are compared by ID
+// rather than entry, since re-adding a track makes a new entry.
+func (p *Playlists) readdTracks(client *spotify.SpotifyClient, sub *model.Subscription, tracks []*model.PlaylistTrack) error {
+	spotifyPlaylist, err := client.GetPlaylist(string(sub.PlaylistOwnerID), string(sub.PlaylistID))
+	if err != nil {
+		return err
+	} else if spotifyPlaylist == nil {
+		return errors.Errorf("Playlist `%s` not found", sub.PlaylistID)
+	}
+	_, currentTracks := jobs.NewPlaylistSnapshot(spotifyPlaylist)
+
+	current := make(map[string]int)
+	for _, track := range currentTracks {
+		current[track.TrackID]++
+	}
+
+	var removed []*model.PlaylistTrack
+	for _, track := range tracks {
+		if current[track.TrackID] > 0 {
+			current[track.TrackID]--
+		} else {
+			removed = append(removed, track)
+		}
+	}
+
+	uris := restorableTrackURIs(removed)
+	glog.Infof("Re-adding removed tracks. userID=%s playlistID=%s trackCount=%d", sub.UserID, sub.PlaylistID, len(uris))
+	if len(uris) == 0 {
+		return nil
+	}
+
+	if _, err := client.AddTracks(string(sub.PlaylistID), uris); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// recreatePlaylist creates a new playlist with a snapshot's details and tracks, and subscribes the user to it.
+func (p *Playlists) recreatePlaylist(client *spotify.SpotifyClient, user *model.User, snapshot *model.Playlist,
+	tracks []*model.PlaylistTrack) error {
+
+	visibility := spotify.PlaylistPrivate
+	if snapshot.Collaborative {
+		visibility = spotify.PlaylistCollaborative
+	}
+
+	created, err := client.CreatePlaylist(string(user.ID), snapshot.Name, visibility)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Recreating playlist. userID=%s playlistID=%s snapshotID=%s newPlaylistID=%s",
+		user.ID, snapshot.ID, snapshot.SnapshotID, created.ID)
+
+	if uris := restorableTrackURIs(tracks); len(uris) > 0 {
+		if _, err := client.AddTracks(created.ID, uris); err != nil {
+			return err
+		}
+	}
+
+	// Subscribe to the playlist with its tracks, so they aren't reported as new activity
+	spotifyPlaylist, err := client.GetPlaylist(created.Owner.ID, created.ID)
+	if err != nil {
+		return err
+	} else if spotifyPlaylist == nil {
+		return errors.Errorf("Playlist `%s` not found", created.ID)
+	}
+
+	if _, err := jobs.CreateSubscription(p.playlistStore, user.ID, spotifyPlaylist, p.clock.Now().Add(jobs.SubscriptionCheckPeriod)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stats charts who has added tracks to the playlist, and which artists and albums, since the user subscribed.
+func (p *Playlists) Stats(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := p.findSubscription(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	} else if sub == nil {
+		Render404(rw, req)
+		return
+	}
+
+	stats, err := p.playlistStore.GetPlaylistStats(sub.Token, playlistStatsLimit)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	client, err := p.spotifyClientFn(user)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	// Contributors are stored by ID, so look up their names. Stats are still useful without them.
+	contributorNames := make(map[string]string)
+	for _, contributor := range stats.Contributors {
+		if len(contributor.Name) == 0 {
+			continue
+		}
+
+		profile, err := client.GetProfile(contributor.Name)
+		if err != nil {
+			glog.Errorf("Error getting contributor profile. userID=%s error=%v", contributor.Name, err)
+		} else if len(profile.DisplayName) > 0 {
+			contributorNames[contributor.Name] = profile.DisplayName
+		}
+	}
+
+	data := &templates.PlaylistStatsViewData{
+		LayoutData:       newLayoutData(req),
+		PlaylistID:       sub.PlaylistID,
+		PlaylistName:     sub.PlaylistName,
+		TrackCount:       stats.TrackCount,
+		ContributorCount: stats.ContributorCount,
+		Contributors:     templates.NewBarChart(templates.NewChartItems(stats.Contributors, contributorNames), stats.TrackCount),
+		TopArtists:       templates.NewBarChart(templates.NewChartItems(stats.TopArtists, nil), stats.TrackCount),
+		TopAlbums:        templates.NewBarChart(templates.NewChartItems(stats.TopAlbums, nil), stats.TrackCount),
+		WeeklyTracks:     templates.NewColumnChart(templates.NewWeeklyChartItems(stats.WeeklyTracks)),
+	}
+
+	if err := templates.PlaylistStatsView.Execute(rw, data); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+func (p *Playlists) StatsAPI(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := p.findSubscription(user, model.PlaylistID(mux.Vars(req)["id"]))
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	} else if sub == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	stats, err := p.playlistStore.GetPlaylistStats(sub.Token, playlistStatsLimit)
+	if err != nil {
+		p.errorHandler(rw, err)
+		return
+	}
+
+	resp := &PlaylistStatsResponse{
+		TrackCount:       stats.TrackCount,
+		ContributorCount: stats.ContributorCount,
+		Contributors:     newStatCountResponses(stats.Contributors),
+		TopArtists:       newStatCountResponses(stats.TopArtists),
+		TopAlbums:        newStatCountResponses(stats.TopAlbums),
+		WeeklyTracks:     make([]*WeeklyCountResponse, len(stats.WeeklyTracks)),
+	}
+	for i, weeklyCount := range stats.WeeklyTracks {
+		resp.WeeklyTracks[i] = &WeeklyCountResponse{WeekOf: weeklyCount.WeekOf.Format("2006-01-02"), Count: weeklyCount.Count}
+	}
+
+	writeJSON(rw, resp, p.errorHandler)
+}
+
+// findSubscription returns the user's subscription to a playlist, or nil if they aren't subscribed. Only
+// subscribers who can still see the playlist can see its history and stats, so subscriptions to unavailable
+// playlists are ignored.
+func (p *Playlists) findSubscription(user *model.User, playlistID model.PlaylistID) (*model.Subscription, error) {
+	subs, err := p.playlistStore.ListSubscriptionsForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		if sub.PlaylistID == playlistID && (sub.Status == model.SubscriptionActive || sub.Status == model.SubscriptionPaused) {
+			return sub, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// loadHistory returns the user's subscription to a playlist and the playlist's stored snapshots. The
+// subscription is nil if the user isn't subscribed. Snapshots stored while the subscription wasn't active
+// were fetched for other subscribers, so they're left out.
+func (p *Playlists) loadHistory(user *model.User, playlistID model.PlaylistID) (*model.Subscription, []*model.Playlist, error) {
+	sub, err := p.findSubscription(user, playlistID)
+	if err != nil || sub == nil {
+		return nil, nil, err
+	}
+
+	allSnapshots, err := p.playlistStore.ListPlaylistSnapshots(playlistID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Legacy snapshots only have track IDs, so can't be shown or restored
+	var snapshots []*model.Playlist
+	for _, snapshot := range allSnapshots {
+		if !snapshot.Legacy {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	if sub.Status != model.SubscriptionActive && sub.StatusChangedAt != nil {
+		var visible []*model.Playlist
+		for _, snapshot := range snapshots {
+			if !snapshot.CreatedAt.After(*sub.StatusChangedAt) {
+				visible = append(visible, snapshot)
+			}
+		}
+		snapshots = visible
+	}
+
+	return sub, snapshots, nil
+}
+
+// selectSnapshot finds the snapshot with the given ID, or else the latest one stored by the given time, or
+// else the one the subscription last saw. See parseTime for the time's format.
+func selectSnapshot(sub *model.Subscription, snapshots []*model.Playlist, snapshotID, at string) (*model.Playlist, error) {
+	if len(snapshotID) > 0 {
+		return findSnapshot(snapshots, snapshotID), nil
+	}
+
+	if len(at) > 0 {
+		atTime, err := parseTime(at)
+		if err != nil {
+			return nil, err
+		}
+
+		// Snapshots are newest first
+		for _, snapshot := range snapshots {
+			if !snapshot.CreatedAt.After(atTime) {
+				return snapshot, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if snapshot := findSnapshot(snapshots, sub.PlaylistVersion); snapshot != nil {
+		return snapshot, nil
+	} else if len(snapshots) > 0 {
+		return snapshots[0], nil
+	}
+
+	return nil, nil
+}
+
+func findSnapshot(snapshots []*model.Playlist, snapshotID string) *model.Playlist {
+	for _, snapshot := range snapshots {
+		if snapshot.SnapshotID == snapshotID {
+			return snapshot
+		}
+	}
+
+	return nil
+}
+
+// restorableTrackURIs returns the URIs of tracks that can be added to a playlist. Local files can't be.
+func restorableTrackURIs(tracks []*model.PlaylistTrack) []string {
+	var uris []string
+	for _, track := range tracks {
+		if track.Metadata != nil && !track.Metadata.Local && len(track.Metadata.URI) > 0 {
+			uris = append(uris, track.Metadata.URI)
+		}
+	}
+
+	return uris
+}
+
+func newStatCountResponses(statCounts []*model.StatCount) []*StatCountResponse {
+	resp := make([]*StatCountResponse, len(statCounts))
+	for i, statCount := range statCounts {
+		resp[i] = &StatCountResponse{Name: statCount.Name, Count: statCount.Count}
+	}
+
+	return resp
+}
+
+func newPlaylistSnapshotResponse(playlist *model.Playlist, tracks []*model.PlaylistTrack) *PlaylistSnapshotResponse {
+	return &PlaylistSnapshotResponse{
+		SnapshotID:    playlist.SnapshotID,
+		Name:          playlist.Name,
+		Description:   playlist.Description,
+		Collaborative: playlist.Collaborative,
+		CreatedAt:     playlist.CreatedAt,
+		Tracks:        newPlaylistTrackResponses(tracks),
+	}
+}
+
+func newPlaylistTrackResponses(tracks []*model.PlaylistTrack) []*PlaylistTrackResponse {
+	resp := make([]*PlaylistTrackResponse, len(tracks))
+	for i, track := range tracks {
+		resp[i] = &PlaylistTrackResponse{
+			Position: track.Position,
+			TrackID:  track.TrackID,
+			AddedAt:  track.AddedAt,
+			AddedBy:  track.AddedBy,
+		}
+		if metadata := track.Metadata; metadata != nil {
+			resp[i].Name = metadata.Name
+			resp[i].ArtistNames = metadata.ArtistNames
+			resp[i].AlbumName = metadata.AlbumName
+			resp[i].URI = metadata.URI
+		}
+	}
+
+	return resp
+}
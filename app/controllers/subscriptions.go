@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/alecholmes/spotlight/app/notifiers"
 	"github.com/alecholmes/spotlight/app/oauth"
 	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/signing"
 	"github.com/alecholmes/spotlight/app/templates"
 	"github.com/alecholmes/spotlight/spotify"
 	"github.com/alecholmes/spotlight/util"
@@ -23,6 +25,12 @@ import (
 	"github.com/gorilla/mux"
 )
 
+const (
+	invitationTTL = 14 * 24 * time.Hour
+
+	maxNotificationFilterEntries = 50
+)
+
 var (
 	emailRegexp = regexp.MustCompile(`^(([^<>()\[\]\.,;:\s@\"]+(\.[^<>()\[\]\.,;:\s@\"]+)*)|(\".+\"))@(([^<>()[\]\.,;:\s@\"]+\.)+[^<>()[\]\.,;:\s@\"]{2,})$`)
 )
@@ -33,27 +41,88 @@ type ShareRequest struct {
 	Email           string           `json:"email"`
 }
 
+type SubscriptionResponse struct {
+	Token              model.SubscriptionToken  `json:"token"`
+	PlaylistID         model.PlaylistID         `json:"playlistId"`
+	PlaylistOwnerID    model.UserID             `json:"playlistOwnerId"`
+	PlaylistName       string                   `json:"playlistName"`
+	Status             model.SubscriptionStatus `json:"status"`
+	StatusChangedAt    *time.Time               `json:"statusChangedAt"`
+	SnoozedUntil       *time.Time               `json:"snoozedUntil"` // Only set while snoozed
+	NotificationFilter *NotificationFilterJSON  `json:"notificationFilter"`
+	UnfollowedAt       *time.Time               `json:"unfollowedAt"`
+	CreatedAt          time.Time                `json:"createdAt"`
+}
+
+// NotificationFilterJSON is a model.NotificationFilter in requests and responses.
+type NotificationFilterJSON struct {
+	IncludeOwn    bool           `json:"includeOwn"`
+	ActorUserIDs  []model.UserID `json:"actorUserIds"`
+	ArtistNames   []string       `json:"artistNames"`
+	MinTrackCount int            `json:"minTrackCount"`
+}
+
+func newSubscriptionResponse(sub *model.Subscription, now time.Time) *SubscriptionResponse {
+	resp := &SubscriptionResponse{
+		Token:           sub.Token,
+		PlaylistID:      sub.PlaylistID,
+		PlaylistOwnerID: sub.PlaylistOwnerID,
+		PlaylistName:    sub.PlaylistName,
+		Status:          sub.Status,
+		StatusChangedAt: sub.StatusChangedAt,
+		NotificationFilter: &NotificationFilterJSON{
+			IncludeOwn:    sub.NotificationFilter.IncludeOwn,
+			ActorUserIDs:  sub.NotificationFilter.ActorUserIDs,
+			ArtistNames:   sub.NotificationFilter.ArtistNames,
+			MinTrackCount: sub.NotificationFilter.MinTrackCount,
+		},
+		UnfollowedAt: sub.UnfollowedAt,
+		CreatedAt:    sub.CreatedAt,
+	}
+	if sub.Snoozed(now) {
+		resp.SnoozedUntil = sub.SnoozedUntil
+	}
+
+	return resp
+}
+
+type SnoozeRequest struct {
+	Until string `json:"until"` // RFC 3339 or a date. Empty to stop snoozing.
+}
+
 type Subscriptions struct {
 	oauth           *oauth.OAuth
+	csrf            *requests.CSRF
 	spotifyClientFn func(user *model.User) (*spotify.SpotifyClient, error)
+	userStore       model.UserStore
 	playlistStore   model.PlaylistStore
+	invitationStore model.InvitationStore
 	notifier        *notifiers.Notifier
+	signer          *signing.Signer
 	errorHandler    func(http.ResponseWriter, error)
 	clock           util.Clock
 }
 
 func NewSubscriptionsController(
 	oauth *oauth.OAuth,
+	csrf *requests.CSRF,
 	spotifyClientFn func(user *model.User) (*spotify.SpotifyClient, error),
+	userStore model.UserStore,
 	playlistStore model.PlaylistStore,
+	invitationStore model.InvitationStore,
 	notifier *notifiers.Notifier,
+	signer *signing.Signer,
 	errorHandler func(http.ResponseWriter, error)) *Subscriptions {
 
 	return &Subscriptions{
 		oauth:           oauth,
+		csrf:            csrf,
 		spotifyClientFn: spotifyClientFn,
+		userStore:       userStore,
 		playlistStore:   playlistStore,
+		invitationStore: invitationStore,
 		notifier:        notifier,
+		signer:          signer,
 		errorHandler:    errorHandler,
 		clock:           util.WallClock,
 	}
@@ -61,23 +130,79 @@ func NewSubscriptionsController(
 
 func (s *Subscriptions) BindToMux(mux *mux.Router) {
 	mux.HandleFunc("/subscriptions",
-		requests.WithContext(s.oauth.MustBeAuthed(s.View, s.errorHandler))).
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.View, s.errorHandler)))).
 		Methods(http.MethodGet)
 	mux.HandleFunc("/subscriptions/create",
-		requests.WithContext(s.oauth.MustBeAuthed(s.Create, s.errorHandler))).
-		Methods(http.MethodGet)
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Create, s.errorHandler)))).
+		Methods(http.MethodPost)
 	mux.HandleFunc("/subscriptions/delete",
-		requests.WithContext(s.oauth.OptionallyAuthed(s.Delete, s.errorHandler))).
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Delete, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/refollow",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Refollow, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/reactivate",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Reactivate, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/cleanup",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Cleanup, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/pause",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Pause, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/resume",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Resume, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/snooze",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.Snooze, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/notifications",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.NotificationFilterView, s.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/subscriptions/notifications",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.UpdateNotificationFilter, s.errorHandler)))).
+		Methods(http.MethodPost)
+
+	// Unsubscribe links from emails. These are authenticated by a signed token rather than a session,
+	// and POST supports RFC 8058 one-click unsubscribes.
+	mux.HandleFunc("/subscriptions/unsubscribe",
+		requests.WithContext(s.csrf.Protect(s.oauth.OptionallyAuthed(s.UnsubscribeView, s.errorHandler)))).
 		Methods(http.MethodGet)
+	mux.HandleFunc("/subscriptions/unsubscribe",
+		requests.WithContext(s.Unsubscribe)).
+		Methods(http.MethodPost)
 
 	mux.HandleFunc("/subscriptions/share",
-		requests.WithContext(s.oauth.OptionallyAuthed(s.ShareView, s.errorHandler))).
+		requests.WithContext(s.csrf.Protect(s.oauth.OptionallyAuthed(s.ShareView, s.errorHandler)))).
 		Methods(http.MethodGet)
+	mux.HandleFunc("/subscriptions/share/accept",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.ShareAccept, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/subscriptions/share/decline",
+		requests.WithContext(s.csrf.Protect(s.oauth.OptionallyAuthed(s.ShareDecline, s.errorHandler)))).
+		Methods(http.MethodPost)
 
 	// REST API for sharing a subscription from the subscriptions view
 	mux.HandleFunc("/subscriptions/share",
-		requests.WithContext(s.oauth.MustBeAuthed(s.ShareCreate, s.errorHandler))).
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.ShareCreate, s.errorHandler)))).
+		Methods(http.MethodPost)
+
+	// REST API for managing subscriptions
+	mux.HandleFunc("/api/subscriptions",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.ListAPI, s.errorHandler)))).
+		Methods(http.MethodGet)
+	mux.HandleFunc("/api/subscriptions/{token}/pause",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.PauseAPI, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/api/subscriptions/{token}/resume",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.ResumeAPI, s.errorHandler)))).
+		Methods(http.MethodPost)
+	mux.HandleFunc("/api/subscriptions/{token}/snooze",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.SnoozeAPI, s.errorHandler)))).
 		Methods(http.MethodPost)
+	mux.HandleFunc("/api/subscriptions/{token}/notification-filter",
+		requests.WithContext(s.csrf.Protect(s.oauth.MustBeAuthed(s.NotificationFilterAPI, s.errorHandler)))).
+		Methods(http.MethodPut)
 }
 
 func (s *Subscriptions) View(rw http.ResponseWriter, req *http.Request) {
@@ -101,15 +226,31 @@ func (s *Subscriptions) View(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	subTokens := make(map[model.PlaylistID]model.SubscriptionToken)
+	subsByPlaylist := make(map[model.PlaylistID]*model.Subscription)
+	var unfollowed []*templates.UnfollowedSubscription
+	var unavailable []*templates.UnavailableSubscription
 	for _, sub := range subs {
-		subTokens[sub.PlaylistID] = sub.Token
+		subsByPlaylist[sub.PlaylistID] = sub
+		if sub.Unavailable() {
+			unavailable = append(unavailable, templates.NewUnavailableSubscription(sub))
+		} else if sub.UnfollowedAt != nil {
+			unfollowed = append(unfollowed, templates.NewUnfollowedSubscription(sub))
+		}
 	}
 
 	playlists := make([]*templates.Playlist, 0, len(allPlaylists))
 	for _, playlist := range allPlaylists {
 		if playlist.Collaborative {
-			playlists = append(playlists, templates.NewPlaylist(playlist, subTokens[model.PlaylistID(playlist.ID)]))
+			sub := subsByPlaylist[model.PlaylistID(playlist.ID)]
+			templated := templates.NewPlaylist(playlist, sub)
+			templated.Owned = playlist.Owner.ID == string(user.ID)
+			if sub != nil {
+				templated.Paused = sub.Status == model.SubscriptionPaused
+				if sub.Snoozed(s.clock.Now()) {
+					templated.SnoozedUntil = sub.SnoozedUntil
+				}
+			}
+			playlists = append(playlists, templated)
 		}
 	}
 
@@ -119,18 +260,18 @@ func (s *Subscriptions) View(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	templatedActivities, err := s.toTemplateActivities(activities, client)
+	templatedActivities, err := s.toTemplateActivities(activities, subs, client)
 	if err != nil {
 		s.errorHandler(rw, err)
 		return
 	}
 
-	// TODO: include deleted playlists in view
-
 	data := &templates.SubscriptionsViewData{
-		LayoutData: templates.LayoutData{SignedIn: true},
-		Activities: templatedActivities,
-		Playlists:  playlists,
+		LayoutData:  newLayoutData(req),
+		Activities:  templatedActivities,
+		Playlists:   playlists,
+		Unfollowed:  unfollowed,
+		Unavailable: unavailable,
 	}
 
 	if err := templates.SubscriptionsView.Execute(rw, data); err != nil {
@@ -138,9 +279,18 @@ func (s *Subscriptions) View(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (s *Subscriptions) toTemplateActivities(activities []*model.Activity, client *spotify.SpotifyClient) ([]*templates.Activity, error) {
+// toTemplateActivities templates activities for the user's subscriptions, whose stored playlist names are
+// shown for playlists that can no longer be fetched.
+func (s *Subscriptions) toTemplateActivities(activities []*model.Activity, subs []*model.Subscription,
+	client *spotify.SpotifyClient) ([]*templates.Activity, error) {
+
 	templated := make([]*templates.Activity, len(activities))
 
+	subsByToken := make(map[model.SubscriptionToken]*model.Subscription, len(subs))
+	for _, sub := range subs {
+		subsByToken[sub.Token] = sub
+	}
+
 	type playlistLookup struct {
 		ownerID    model.UserID
 		playlistID model.PlaylistID
@@ -151,7 +301,9 @@ func (s *Subscriptions) toTemplateActivities(activities []*model.Activity, clien
 	playlists := make(map[model.PlaylistID]*spotify.Playlist)
 
 	for _, activity := range activities {
-		users[activity.Data.ActorUserID] = nil
+		if len(activity.Data.ActorUserID) > 0 {
+			users[activity.Data.ActorUserID] = nil
+		}
 
 		playlistLookup := playlistLookup{
 			ownerID:    activity.Data.PlaylistOwnerID,
@@ -177,7 +329,8 @@ func (s *Subscriptions) toTemplateActivities(activities []*model.Activity, clien
 	}
 
 	for i, activity := range activities {
-		templated[i] = templates.NewActivity(activity, users[activity.Data.ActorUserID], playlists[activity.Data.PlaylistID])
+		templated[i] = templates.NewActivity(activity, users[activity.Data.ActorUserID], playlists[activity.Data.PlaylistID],
+			subsByToken[activity.SubscriptionToken])
 	}
 
 	return templated, nil
@@ -186,8 +339,8 @@ func (s *Subscriptions) toTemplateActivities(activities []*model.Activity, clien
 func (s *Subscriptions) Create(rw http.ResponseWriter, req *http.Request) {
 	user := requests.MustUserFromContext(req.Context())
 
-	ownerID := req.URL.Query().Get("ownerId")
-	playlistID := req.URL.Query().Get("playlistId")
+	ownerID := req.FormValue("ownerId")
+	playlistID := req.FormValue("playlistId")
 	if len(ownerID) == 0 || len(playlistID) == 0 {
 		glog.Infof("Attempt to create subscription without IDs set. ownerID=`%s` playlistID=`%s`", ownerID, playlistID)
 		rw.Header().Set("Location", "/subscriptions")
@@ -195,42 +348,90 @@ func (s *Subscriptions) Create(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	client, err := s.spotifyClientFn(user)
-	if err != nil {
+	if err := s.subscribe(user, model.UserID(ownerID), model.PlaylistID(playlistID)); err != nil {
 		s.errorHandler(rw, err)
 		return
 	}
 
-	playlist, err := client.GetPlaylist(ownerID, playlistID)
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (s *Subscriptions) subscribe(user *model.User, ownerID model.UserID, playlistID model.PlaylistID) error {
+	client, err := s.spotifyClientFn(user)
 	if err != nil {
-		s.errorHandler(rw, err)
-		return
+		return err
+	}
+
+	playlist, err := client.GetPlaylist(string(ownerID), string(playlistID))
+	if err != nil {
+		return err
 	} else if playlist == nil {
 		// TODO: 404
-		s.errorHandler(rw, fmt.Errorf("Playlist not found"))
-		return
+		return fmt.Errorf("Playlist not found")
 	}
 
 	nextCheckAt := s.clock.Now().Add(jobs.SubscriptionCheckPeriod)
-	sub := newSubscription(user.ID, playlist, nextCheckAt)
-
-	if _, err := s.playlistStore.CreateSubscription(sub); err != nil {
-		s.errorHandler(rw, fmt.Errorf("Playlist not found"))
-		return
+	if _, err := jobs.CreateSubscription(s.playlistStore, user.ID, playlist, nextCheckAt); err != nil {
+		return fmt.Errorf("Playlist not found")
 	}
 
 	if playlist.Owner.ID != string(user.ID) {
 		if _, err := client.FollowPlaylist(playlist.Owner.ID, playlist.ID, true); err != nil {
-			s.errorHandler(rw, err)
+			return err
+		}
+
+		// The subscription already succeeded, so don't fail it over notifications
+		if err := s.recordFollow(client, user, playlist); err != nil {
+			glog.Errorf("Error recording playlist follow. userID=%s playlistID=%s error=%v", user.ID, playlist.ID, err)
 		}
 	}
 
-	rw.Header().Set("Location", "/subscriptions")
-	rw.WriteHeader(http.StatusFound)
+	return nil
+}
+
+// recordFollow adds a PlaylistFollowed activity for each of the playlist's other active subscribers and emails them.
+func (s *Subscriptions) recordFollow(client *spotify.SpotifyClient, follower *model.User, playlist *spotify.Playlist) error {
+	subs, err := s.playlistStore.ListSubscriptionsForPlaylist(model.PlaylistID(playlist.ID))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, sub := range subs {
+		// Paused or unavailable subscribers don't get activity, as in the update job
+		if sub.UserID == follower.ID || sub.Status != model.SubscriptionActive {
+			continue
+		}
+
+		if _, err := s.playlistStore.AppendActivities(sub, []*model.ActivityData{{
+			PlaylistID:       model.PlaylistID(playlist.ID),
+			PlaylistOwnerID:  model.UserID(playlist.Owner.ID),
+			PlaylistFollowed: &model.PlaylistFollowed{},
+			ActorUserID:      follower.ID,
+			OccuredAt:        s.clock.Now(),
+		}}); err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		subscriber, err := s.userStore.GetUser(sub.UserID)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		} else if subscriber == nil {
+			continue
+		}
+
+		if err := jobs.NotifySubscription(s.playlistStore, s.notifier, client, subscriber, sub); err != nil {
+			glog.Errorf("Error notifying: %v", err)
+		}
+	}
+
+	return nil
 }
 
 func (s *Subscriptions) Delete(rw http.ResponseWriter, req *http.Request) {
-	subToken := model.SubscriptionToken(req.URL.Query().Get("token"))
+	user := requests.MustUserFromContext(req.Context())
+
+	subToken := model.SubscriptionToken(req.FormValue("token"))
 	if len(subToken) == 0 {
 		glog.Info("Attempt to delete subscription without token set")
 		rw.Header().Set("Location", "/subscriptions")
@@ -238,25 +439,564 @@ func (s *Subscriptions) Delete(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// TODO this is racy w.r.t the update job. Need to serialize on subscription or something like that.
-	deleted, err := s.playlistStore.DeleteSubscription(subToken)
+	sub, err := s.playlistStore.GetSubscription(subToken)
 	if err != nil {
 		s.errorHandler(rw, err)
 		return
 	}
-	if !deleted {
-		glog.Infof("Attempt to delete subscription that does not exist. subscriptionToken=`%s`", subToken)
-	}
 
-	if authed := requests.UserFromContext(req.Context()) != nil; authed {
+	if sub == nil || sub.UserID != user.ID {
+		glog.Infof("Attempt to delete subscription that does not exist. userID=`%s` subscriptionToken=`%s`", user.ID, subToken)
 		rw.Header().Set("Location", "/subscriptions")
-	} else {
-		rw.Header().Set("Location", "/")
+		rw.WriteHeader(http.StatusFound)
+		return
+	}
+
+	// Owners can't unfollow their own playlists without deleting them
+	if req.FormValue("unfollow") == "true" && sub.PlaylistOwnerID != user.ID {
+		client, err := s.spotifyClientFn(user)
+		if err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+
+		if err := client.UnfollowPlaylist(string(sub.PlaylistOwnerID), string(sub.PlaylistID)); err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+		glog.Infof("Unfollowed playlist. userID=`%s` playlistID=`%s`", user.ID, sub.PlaylistID)
+	}
+
+	if err := s.deleteSubscription(subToken); err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+// Refollow follows a subscribed playlist again in Spotify after the user unfollowed it there, so that
+// the subscription is checked again.
+func (s *Subscriptions) Refollow(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(req.FormValue("token")))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	if sub == nil || sub.UserID != user.ID {
+		glog.Infof("Attempt to refollow subscription that does not exist. userID=`%s` subscriptionToken=`%s`", user.ID, req.FormValue("token"))
+	} else if sub.UnfollowedAt != nil {
+		client, err := s.spotifyClientFn(user)
+		if err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+
+		if _, err := client.FollowPlaylist(string(sub.PlaylistOwnerID), string(sub.PlaylistID), true); err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+
+		sub.UnfollowedAt = nil
+		if err := s.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+		glog.Infof("Refollowed playlist. userID=`%s` playlistID=`%s`", user.ID, sub.PlaylistID)
+	}
+
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+// Reactivate checks a subscription again that stopped because its playlist was deleted or the user lost
+// access to it, if the user can fetch the playlist now.
+func (s *Subscriptions) Reactivate(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(req.FormValue("token")))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	if sub == nil || sub.UserID != user.ID {
+		glog.Infof("Attempt to reactivate subscription that does not exist. userID=`%s` subscriptionToken=`%s`", user.ID, req.FormValue("token"))
+	} else if sub.Unavailable() {
+		client, err := s.spotifyClientFn(user)
+		if err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+
+		playlist, err := client.GetPlaylist(string(sub.PlaylistOwnerID), string(sub.PlaylistID))
+		if err != nil {
+			s.errorHandler(rw, err)
+			return
+		} else if playlist == nil {
+			glog.Infof("Playlist still unavailable. userID=`%s` playlistID=`%s`", user.ID, sub.PlaylistID)
+		} else if _, err := jobs.CreateSubscription(s.playlistStore, user.ID, playlist, s.clock.Now()); err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+	}
+
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+// Cleanup deletes all of the user's subscriptions to playlists that are unavailable.
+func (s *Subscriptions) Cleanup(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	subs, err := s.playlistStore.ListSubscriptionsForUser(user.ID)
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	for _, sub := range subs {
+		if !sub.Unavailable() {
+			continue
+		}
+
+		if err := s.deleteSubscription(sub.Token); err != nil {
+			s.errorHandler(rw, err)
+			return
+		}
+		glog.Infof("Deleted unavailable subscription. userID=`%s` playlistID=`%s` status=%s", user.ID, sub.PlaylistID, sub.Status)
+	}
+
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (s *Subscriptions) Pause(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscription(rw, req, func(sub *model.Subscription) error {
+		_, err := s.setPaused(sub, true)
+		return err
+	})
+}
+
+func (s *Subscriptions) Resume(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscription(rw, req, func(sub *model.Subscription) error {
+		_, err := s.setPaused(sub, false)
+		return err
+	})
+}
+
+// Snooze stops notifications for a subscription until the end of the given date, or stops snoozing if
+// no date is given.
+func (s *Subscriptions) Snooze(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscription(rw, req, func(sub *model.Subscription) error {
+		until, err := s.parseSnoozeUntil(req.FormValue("until"))
+		if err != nil {
+			glog.Infof("Attempt to snooze subscription with bad time. subscriptionToken=`%s` until=`%s`", sub.Token, req.FormValue("until"))
+			return nil
+		}
+
+		return s.snooze(sub, until)
+	})
+}
+
+// NotificationFilterView shows a form for choosing which of a subscription's activities are notified.
+func (s *Subscriptions) NotificationFilterView(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(req.FormValue("token")))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	} else if sub == nil || sub.UserID != user.ID {
+		Render404(rw, req)
+		return
+	}
+
+	collaborators, err := s.filterCollaborators(user, sub)
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	filter := sub.NotificationFilter
+	data := &templates.NotificationFilterViewData{
+		LayoutData:    newLayoutData(req),
+		Token:         sub.Token,
+		PlaylistName:  sub.PlaylistName,
+		IncludeOwn:    filter.IncludeOwn,
+		Collaborators: collaborators,
+		ArtistNames:   strings.Join(filter.ArtistNames, ", "),
+		MinTrackCount: filter.MinTrackCount,
+	}
+
+	if err := templates.NotificationFilterView.Execute(rw, data); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+// filterCollaborators lists the other users who can be chosen in a subscription's notification filter:
+// the playlist's owner, whoever added its current tracks and anyone already chosen.
+func (s *Subscriptions) filterCollaborators(user *model.User, sub *model.Subscription) ([]*templates.FilterCollaborator, error) {
+	userIDs := []model.UserID{sub.PlaylistOwnerID}
+	_, tracks, err := s.playlistStore.GetPlaylist(sub.PlaylistID, sub.PlaylistVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, track := range tracks {
+		userIDs = append(userIDs, track.AddedBy)
+	}
+	userIDs = append(userIDs, sub.NotificationFilter.ActorUserIDs...)
+
+	selected := make(map[model.UserID]bool)
+	for _, userID := range sub.NotificationFilter.ActorUserIDs {
+		selected[userID] = true
+	}
+
+	client, err := s.spotifyClientFn(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var collaborators []*templates.FilterCollaborator
+	seen := map[model.UserID]bool{user.ID: true, "": true}
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		// The ID is still a usable name if the profile can't be loaded
+		collaborator := &templates.FilterCollaborator{UserID: userID, Name: string(userID), Selected: selected[userID]}
+		if profile, err := client.GetProfile(string(userID)); err != nil {
+			glog.Errorf("Error getting collaborator profile. userID=%s error=%v", userID, err)
+		} else if len(profile.DisplayName) > 0 {
+			collaborator.Name = profile.DisplayName
+		}
+
+		collaborators = append(collaborators, collaborator)
+	}
+
+	return collaborators, nil
+}
+
+func (s *Subscriptions) UpdateNotificationFilter(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscription(rw, req, func(sub *model.Subscription) error {
+		minTrackCount := 0
+		if value := req.FormValue("minTracks"); len(value) > 0 {
+			var err error
+			if minTrackCount, err = strconv.Atoi(value); err != nil {
+				glog.Infof("Attempt to save notification filter with bad track count. subscriptionToken=`%s` minTracks=`%s`", sub.Token, value)
+				return nil
+			}
+		}
+
+		var actorUserIDs []model.UserID
+		for _, userID := range req.Form["collaborator"] {
+			actorUserIDs = append(actorUserIDs, model.UserID(userID))
+		}
+
+		filter, ok := newNotificationFilter(req.FormValue("includeOwn") == "true", actorUserIDs,
+			strings.Split(req.FormValue("artists"), ","), minTrackCount)
+		if !ok {
+			glog.Infof("Attempt to save invalid notification filter. subscriptionToken=`%s` form=%v", sub.Token, req.Form)
+			return nil
+		}
+
+		return s.updateNotificationFilter(sub, filter)
+	})
+}
+
+func (s *Subscriptions) NotificationFilterAPI(rw http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	filterReq := new(NotificationFilterJSON)
+	if err := json.NewDecoder(req.Body).Decode(filterReq); err != nil {
+		glog.Infof("Error decoding notification filter request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	filter, ok := newNotificationFilter(filterReq.IncludeOwn, filterReq.ActorUserIDs, filterReq.ArtistNames, filterReq.MinTrackCount)
+	if !ok {
+		glog.Infof("Invalid notification filter request: %+v", filterReq)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.changeSubscriptionAPI(rw, req, func(sub *model.Subscription) (bool, error) {
+		return true, s.updateNotificationFilter(sub, filter)
+	})
+}
+
+func (s *Subscriptions) updateNotificationFilter(sub *model.Subscription, filter *model.NotificationFilter) error {
+	sub.NotificationFilter = *filter
+	if err := s.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+		return err
+	}
+	glog.Infof("Updated notification filter. subscriptionToken=`%s` filter=%+v", sub.Token, filter)
+
+	return nil
+}
+
+// newNotificationFilter cleans up a notification filter, ignoring empty and repeated entries. Returns false
+// if it's invalid.
+func newNotificationFilter(includeOwn bool, actorUserIDs []model.UserID, artistNames []string, minTrackCount int) (*model.NotificationFilter, bool) {
+	filter := &model.NotificationFilter{
+		IncludeOwn:    includeOwn,
+		MinTrackCount: minTrackCount,
+	}
+
+	seenUserIDs := make(map[model.UserID]bool)
+	for _, userID := range actorUserIDs {
+		if len(userID) > 0 && !seenUserIDs[userID] {
+			seenUserIDs[userID] = true
+			filter.ActorUserIDs = append(filter.ActorUserIDs, userID)
+		}
+	}
+
+	seenNames := make(map[string]bool)
+	for _, name := range artistNames {
+		name = strings.TrimSpace(name)
+		if key := strings.ToLower(name); len(name) > 0 && !seenNames[key] {
+			seenNames[key] = true
+			filter.ArtistNames = append(filter.ArtistNames, name)
+		}
+	}
+
+	if minTrackCount < 0 || len(filter.ActorUserIDs) > maxNotificationFilterEntries ||
+		len(filter.ArtistNames) > maxNotificationFilterEntries {
+		return nil, false
 	}
 
+	return filter, true
+}
+
+// changeSubscription applies a change to the subscription in the form, if it's the user's, and redirects
+// back to the subscriptions view.
+func (s *Subscriptions) changeSubscription(rw http.ResponseWriter, req *http.Request, change func(sub *model.Subscription) error) {
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(req.FormValue("token")))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	if sub == nil || sub.UserID != user.ID {
+		glog.Infof("Attempt to change subscription that does not exist. userID=`%s` subscriptionToken=`%s` URL=`%v`",
+			user.ID, req.FormValue("token"), req.URL)
+	} else if err := change(sub); err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	rw.Header().Set("Location", "/subscriptions")
 	rw.WriteHeader(http.StatusFound)
 }
 
+func (s *Subscriptions) ListAPI(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	subs, err := s.playlistStore.ListSubscriptionsForUser(user.ID)
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	now := s.clock.Now()
+	resp := make([]*SubscriptionResponse, len(subs))
+	for i, sub := range subs {
+		resp[i] = newSubscriptionResponse(sub, now)
+	}
+
+	writeJSON(rw, resp, s.errorHandler)
+}
+
+func (s *Subscriptions) PauseAPI(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscriptionAPI(rw, req, func(sub *model.Subscription) (bool, error) {
+		return s.setPaused(sub, true)
+	})
+}
+
+func (s *Subscriptions) ResumeAPI(rw http.ResponseWriter, req *http.Request) {
+	s.changeSubscriptionAPI(rw, req, func(sub *model.Subscription) (bool, error) {
+		return s.setPaused(sub, false)
+	})
+}
+
+func (s *Subscriptions) SnoozeAPI(rw http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	snoozeReq := new(SnoozeRequest)
+	if err := json.NewDecoder(req.Body).Decode(snoozeReq); err != nil {
+		glog.Infof("Error decoding snooze request: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	until, err := s.parseSnoozeUntil(snoozeReq.Until)
+	if err != nil {
+		glog.Infof("Invalid snooze request: %+v", snoozeReq)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.changeSubscriptionAPI(rw, req, func(sub *model.Subscription) (bool, error) {
+		return true, s.snooze(sub, until)
+	})
+}
+
+// changeSubscriptionAPI applies a change to the user's subscription in the URL and responds with it. The
+// change returns false if it doesn't apply to the subscription's current status.
+func (s *Subscriptions) changeSubscriptionAPI(rw http.ResponseWriter, req *http.Request,
+	change func(sub *model.Subscription) (bool, error)) {
+
+	user := requests.MustUserFromContext(req.Context())
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(mux.Vars(req)["token"]))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	} else if sub == nil || sub.UserID != user.ID {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if ok, err := change(sub); err != nil {
+		s.errorHandler(rw, err)
+		return
+	} else if !ok {
+		glog.Infof("Attempt to change subscription with status %s. subscriptionToken=`%s` URL=`%v`", sub.Status, sub.Token, req.URL)
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	writeJSON(rw, newSubscriptionResponse(sub, s.clock.Now()), s.errorHandler)
+}
+
+// setPaused pauses an active subscription or resumes a paused one. Returns false if the subscription
+// is neither, e.g. because its playlist is unavailable.
+func (s *Subscriptions) setPaused(sub *model.Subscription, paused bool) (bool, error) {
+	from, to := model.SubscriptionActive, model.SubscriptionPaused
+	if !paused {
+		from, to = to, from
+	}
+
+	if sub.Status == to {
+		return true, nil
+	} else if sub.Status != from {
+		return false, nil
+	}
+
+	now := s.clock.Now()
+	sub.SetStatus(to, now)
+	if !paused {
+		// Changes made while paused are found by the next check
+		sub.NextCheckAt = &now
+	}
+
+	if err := s.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+		return false, err
+	}
+	glog.Infof("Changed subscription status. subscriptionToken=`%s` status=%s", sub.Token, to)
+
+	return true, nil
+}
+
+func (s *Subscriptions) snooze(sub *model.Subscription, until *time.Time) error {
+	sub.SnoozedUntil = until
+	if err := s.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+		return err
+	}
+	glog.Infof("Snoozed subscription. subscriptionToken=`%s` until=%v", sub.Token, until)
+
+	return nil
+}
+
+// parseSnoozeUntil parses when to snooze a subscription until. It's nil if the value is empty or in the
+// past, which stops snoozing.
+func (s *Subscriptions) parseSnoozeUntil(value string) (*time.Time, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	until, err := parseTime(value)
+	if err != nil {
+		return nil, err
+	} else if !until.After(s.clock.Now()) {
+		return nil, nil
+	}
+
+	return &until, nil
+}
+
+func (s *Subscriptions) UnsubscribeView(rw http.ResponseWriter, req *http.Request) {
+	subToken, err := s.signer.Verify(signing.PurposeUnsubscribe, req.URL.Query().Get("token"), s.clock.Now())
+	if err != nil {
+		glog.Infof("Attempt to view unsubscribe with bad token: %v", err)
+		rw.Header().Set("Location", "/")
+		rw.WriteHeader(http.StatusFound)
+		return
+	}
+
+	sub, err := s.playlistStore.GetSubscription(model.SubscriptionToken(subToken))
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	viewData := &templates.UnsubscribeViewData{
+		LayoutData:     newLayoutData(req),
+		UnsubscribeURL: req.URL.RequestURI(),
+		Unsubscribed:   sub == nil,
+	}
+	if sub != nil {
+		viewData.PlaylistName = sub.PlaylistName
+	}
+
+	if err := templates.UnsubscribeView.Execute(rw, viewData); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+func (s *Subscriptions) Unsubscribe(rw http.ResponseWriter, req *http.Request) {
+	subToken, err := s.signer.Verify(signing.PurposeUnsubscribe, req.URL.Query().Get("token"), s.clock.Now())
+	if err != nil {
+		glog.Infof("Attempt to unsubscribe with bad token: %v", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.deleteSubscription(model.SubscriptionToken(subToken)); err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	viewData := &templates.UnsubscribeViewData{
+		Unsubscribed: true,
+	}
+
+	if err := templates.UnsubscribeView.Execute(rw, viewData); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+func (s *Subscriptions) deleteSubscription(subToken model.SubscriptionToken) error {
+	// TODO this is racy w.r.t the update job. Need to serialize on subscription or something like that.
+	// The opt-out stops the user being subscribed again automatically
+	deleted, err := s.playlistStore.OptOutOfSubscription(subToken)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		glog.Infof("Attempt to delete subscription that does not exist. subscriptionToken=`%s`", subToken)
+	}
+
+	return nil
+}
+
 func (s *Subscriptions) ShareCreate(rw http.ResponseWriter, req *http.Request) {
 	user := requests.MustUserFromContext(req.Context())
 
@@ -297,7 +1037,20 @@ func (s *Subscriptions) ShareCreate(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := s.notifier.SharePlaylist(client, shareReq.Email, playlist); err != nil {
+	invitation, err := s.invitationStore.CreateInvitation(&model.Invitation{
+		InviterUserID:   user.ID,
+		InviteeEmail:    shareReq.Email,
+		PlaylistID:      model.PlaylistID(playlist.ID),
+		PlaylistOwnerID: model.UserID(playlist.Owner.ID),
+		PlaylistName:    playlist.Name,
+		ExpiresAt:       s.clock.Now().Add(invitationTTL),
+	})
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
+
+	if err := s.notifier.SharePlaylist(user, invitation, playlist); err != nil {
 		glog.Errorf("Error sharing playlist: %v", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
@@ -309,59 +1062,130 @@ func (s *Subscriptions) ShareCreate(rw http.ResponseWriter, req *http.Request) {
 func (s *Subscriptions) ShareView(rw http.ResponseWriter, req *http.Request) {
 	user := requests.UserFromContext(req.Context())
 
-	inviterName := req.URL.Query().Get("inviterName")
-	inviterEmail := req.URL.Query().Get("inviterEmail")
-	ownerID := req.URL.Query().Get("ownerId")
-	playlistID := req.URL.Query().Get("playlistId")
-	playlistName := req.URL.Query().Get("playlistName")
+	invitation, ok := s.loadInvitation(rw, req)
+	if !ok {
+		return
+	}
 
-	if len(inviterName) == 0 || len(inviterEmail) == 0 || len(ownerID) == 0 || len(playlistID) == 0 || len(playlistName) == 0 {
-		glog.Infof("Attempt to view share without IDs set. inviterName=`%s` inviterEmail=`%s` ownerID=`%s` playlistID=`%s` playlistName=`%s`",
-			inviterName, inviterEmail, ownerID, playlistID, playlistName)
+	inviter, err := s.userStore.GetUser(invitation.InviterUserID)
+	if err != nil {
+		s.errorHandler(rw, err)
+		return
+	} else if inviter == nil {
+		glog.Infof("Inviter for share no longer exists. invitationToken=`%s` inviterUserID=`%s`",
+			invitation.Token, invitation.InviterUserID)
 		rw.Header().Set("Location", "/")
 		rw.WriteHeader(http.StatusFound)
 		return
 	}
 
-	// If authenticated, use the normal subscribe endpoint
-	if user != nil {
-		s.Create(rw, req)
+	viewData := &templates.ShareViewData{
+		LayoutData:      newLayoutData(req),
+		InviterName:     inviter.Name,
+		InviterEmail:    inviter.Email,
+		PlaylistName:    invitation.PlaylistName,
+		InvitationToken: string(invitation.Token),
+	}
+	if user == nil {
+		query := make(url.Values)
+		query.Set("next", req.URL.RequestURI())
+		viewData.SignInURL = fmt.Sprintf("/login?%s", query.Encode())
+	}
+
+	if err := templates.ShareView.Execute(rw, viewData); err != nil {
+		glog.Errorf("Unable to render template: %v", err)
+	}
+}
+
+func (s *Subscriptions) ShareAccept(rw http.ResponseWriter, req *http.Request) {
+	user := requests.MustUserFromContext(req.Context())
+
+	invitation, ok := s.loadInvitation(rw, req)
+	if !ok {
 		return
 	}
 
-	query := make(url.Values)
-	query.Set("ownerId", ownerID)
-	query.Set("playlistId", playlistID)
-	subscribeURL := fmt.Sprintf("/subscriptions/create?%s", query.Encode())
+	if err := s.subscribe(user, invitation.PlaylistOwnerID, invitation.PlaylistID); err != nil {
+		s.errorHandler(rw, err)
+		return
+	}
 
-	viewData := &templates.ShareViewData{
-		LayoutData:   templates.LayoutData{SignedIn: user != nil},
-		InviterName:  inviterName,
-		InviterEmail: inviterEmail,
-		PlaylistName: playlistName,
-		SubscribeURL: subscribeURL,
+	if err := s.respondToInvitation(invitation, model.InvitationAccepted, user); err != nil {
+		s.errorHandler(rw, err)
+		return
 	}
 
-	if err := templates.ShareView.Execute(rw, viewData); err != nil {
-		glog.Errorf("Unable to render template: %v", err)
+	rw.Header().Set("Location", "/subscriptions")
+	rw.WriteHeader(http.StatusFound)
+}
+
+func (s *Subscriptions) ShareDecline(rw http.ResponseWriter, req *http.Request) {
+	user := requests.UserFromContext(req.Context())
+
+	invitation, ok := s.loadInvitation(rw, req)
+	if !ok {
+		return
+	}
+
+	if err := s.respondToInvitation(invitation, model.InvitationDeclined, user); err != nil {
+		s.errorHandler(rw, err)
+		return
 	}
+
+	rw.Header().Set("Location", "/")
+	rw.WriteHeader(http.StatusFound)
 }
 
-func newSubscription(userID model.UserID, playlist *spotify.Playlist, nextCheckAt time.Time) *model.Subscription {
-	sub := &model.Subscription{
-		UserID:          userID,
-		PlaylistID:      model.PlaylistID(playlist.ID),
-		PlaylistOwnerID: model.UserID(playlist.Owner.ID),
-		PlaylistName:    playlist.Name,
+// loadInvitation returns the pending, unexpired invitation referenced by the request. If there is
+// no such invitation then the response is redirected and false is returned.
+func (s *Subscriptions) loadInvitation(rw http.ResponseWriter, req *http.Request) (*model.Invitation, bool) {
+	token := model.InvitationToken(req.FormValue("token"))
+	if len(token) == 0 {
+		glog.Info("Attempt to view share without token set")
+		rw.Header().Set("Location", "/")
+		rw.WriteHeader(http.StatusFound)
+		return nil, false
 	}
 
-	updateSubscription(sub, playlist, nextCheckAt)
+	invitation, err := s.invitationStore.GetInvitation(token)
+	if err != nil {
+		s.errorHandler(rw, err)
+		return nil, false
+	}
 
-	return sub
+	if invitation == nil || invitation.Status != model.InvitationPending || invitation.Expired(s.clock.Now()) {
+		if invitation == nil {
+			glog.Infof("Attempt to view share that does not exist. invitationToken=`%s`", token)
+		} else {
+			glog.Infof("Attempt to view share that is no longer pending. invitationToken=`%s` status=%s expiresAt=%v",
+				token, invitation.Status, invitation.ExpiresAt)
+		}
+
+		rw.Header().Set("Location", "/")
+		if requests.UserFromContext(req.Context()) != nil {
+			rw.Header().Set("Location", "/subscriptions")
+		}
+		rw.WriteHeader(http.StatusFound)
+		return nil, false
+	}
+
+	return invitation, true
 }
 
-func updateSubscription(sub *model.Subscription, playlist *spotify.Playlist, nextCheckAt time.Time) {
-	sub.PlaylistVersion = playlist.SnapshotID
-	sub.PlaylistTracks = []byte(strings.Join(spotify.PlaylistTrackIDs(playlist), ","))
-	sub.NextCheckAt = &nextCheckAt
+func (s *Subscriptions) respondToInvitation(invitation *model.Invitation, status model.InvitationStatus, user *model.User) error {
+	now := s.clock.Now()
+
+	invitation.Status = status
+	invitation.RespondedAt = &now
+	if user != nil {
+		invitation.ResponderUserID = &user.ID
+	}
+
+	if err := s.invitationStore.UpdateInvitation(invitation); err != nil {
+		return err
+	}
+
+	glog.Infof("Responded to invitation. invitationToken=`%s` status=%s", invitation.Token, status)
+
+	return nil
 }
@@ -1,8 +1,11 @@
 package controllers
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/alecholmes/spotlight/app/requests"
 	"github.com/alecholmes/spotlight/app/templates"
 
 	"github.com/go-errors/errors"
@@ -21,7 +24,7 @@ func Render404(rw http.ResponseWriter, req *http.Request) {
 
 func Render500(rw http.ResponseWriter, err error) {
 	if stackErr, ok := err.(*errors.Error); ok {
-		glog.Errorf(stackErr.ErrorStack())
+		glog.Error(stackErr.ErrorStack())
 	} else {
 		glog.Error(err)
 	}
@@ -30,3 +33,35 @@ func Render500(rw http.ResponseWriter, err error) {
 		glog.Errorf("Error rendering 500 template: %v", err)
 	}
 }
+
+func newLayoutData(req *http.Request) templates.LayoutData {
+	return templates.LayoutData{
+		SignedIn:  requests.UserFromContext(req.Context()) != nil,
+		CSRFToken: requests.CSRFTokenFromContext(req.Context()),
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, data interface{}, errorHandler func(http.ResponseWriter, error)) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		errorHandler(rw, errors.Wrap(err, 0))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(body)
+}
+
+// parseTime parses either an RFC 3339 time or a date, which means the end of that day in UTC.
+func parseTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		date, dateErr := time.Parse("2006-01-02", value)
+		if dateErr != nil {
+			return time.Time{}, errors.Wrap(err, 0)
+		}
+		t = date.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return t, nil
+}
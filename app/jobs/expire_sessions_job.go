@@ -0,0 +1,31 @@
+package jobs
+
+import (
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+// ExpireSessionsJob deletes sessions that have passed their idle or absolute timeout.
+type ExpireSessionsJob struct {
+	sessionStore model.SessionStore
+}
+
+func NewExpireSessionsJob(sessionStore model.SessionStore) *ExpireSessionsJob {
+	return &ExpireSessionsJob{sessionStore: sessionStore}
+}
+
+func (e *ExpireSessionsJob) Run() error {
+	count, err := e.sessionStore.DeleteExpiredSessions(util.WallClock.Now())
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if count > 0 {
+		glog.Infof("Deleted expired sessions. count=%d", count)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package jobs
+
+import (
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/notifiers"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	notifyReauthBatchSize = 20
+)
+
+// NotifyReauthJob emails users whose Spotify authorization was revoked, once per revocation. Revocations
+// are found wherever a user's token is refreshed, so they're all notified from here, and failed emails are
+// retried on the next run.
+type NotifyReauthJob struct {
+	userStore model.UserStore
+	notifier  *notifiers.Notifier
+}
+
+func NewNotifyReauthJob(userStore model.UserStore, notifier *notifiers.Notifier) *NotifyReauthJob {
+	return &NotifyReauthJob{
+		userStore: userStore,
+		notifier:  notifier,
+	}
+}
+
+func (n *NotifyReauthJob) Run() error {
+	users, err := n.userStore.ListUsersToNotifyReauth(notifyReauthBatchSize)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		// One user's failure shouldn't hold up everyone else
+		if err := n.notifyReauth(user); err != nil {
+			glog.Errorf("Error notifying user that re-authorization is required. userID=%s error=%v", user.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (n *NotifyReauthJob) notifyReauth(user *model.User) error {
+	// Retrying can't help without an email address, so don't keep the user in every batch
+	if len(user.Email) == 0 {
+		glog.Infof("Not notifying user without an email that re-authorization is required. userID=%s", user.ID)
+	} else {
+		glog.Infof("Notifying user that re-authorization is required. userID=%s", user.ID)
+		if err := n.notifier.ReauthRequired(user); err != nil {
+			return err
+		}
+	}
+
+	if err := n.userStore.MarkReauthNotified(user.ID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
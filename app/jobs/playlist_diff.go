@@ -0,0 +1,248 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/spotify"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/golang/glog"
+)
+
+// NewPlaylistSnapshot converts a playlist fetched from Spotify into a snapshot for storing.
+// Unavailable tracks are left out.
+func NewPlaylistSnapshot(spotifyPlaylist *spotify.Playlist) (*model.Playlist, []*model.PlaylistTrack) {
+	playlist := &model.Playlist{
+		ID:            model.PlaylistID(spotifyPlaylist.ID),
+		SnapshotID:    spotifyPlaylist.SnapshotID,
+		OwnerID:       model.UserID(spotifyPlaylist.Owner.ID),
+		Name:          spotifyPlaylist.Name,
+		Description:   spotifyPlaylist.Description,
+		Collaborative: spotifyPlaylist.Collaborative,
+	}
+
+	tracks := make([]*model.PlaylistTrack, 0, len(spotifyPlaylist.PlaylistTracks))
+	for _, track := range spotifyPlaylist.PlaylistTracks {
+		if track.Track == nil {
+			continue
+		}
+
+		playlistTrack := &model.PlaylistTrack{
+			PlaylistID: playlist.ID,
+			SnapshotID: playlist.SnapshotID,
+			Position:   len(tracks),
+			TrackID:    spotify.TrackKey(track),
+			Metadata:   trackMetadata(track),
+		}
+		if !track.AddedAt.IsZero() {
+			addedAt := track.AddedAt
+			playlistTrack.AddedAt = &addedAt
+		}
+		if track.AddedBy != nil {
+			playlistTrack.AddedBy = model.UserID(track.AddedBy.ID)
+		}
+
+		tracks = append(tracks, playlistTrack)
+	}
+
+	return playlist, tracks
+}
+
+// CreateSubscription stores the playlist's current snapshot and subscribes the user to it. If the user's
+// existing subscription stopped because the playlist was unavailable, it's checked again, since the
+// playlist was just fetched.
+func CreateSubscription(playlistStore model.PlaylistStore, userID model.UserID, spotifyPlaylist *spotify.Playlist,
+	nextCheckAt time.Time) (*model.Subscription, error) {
+
+	playlist, tracks := NewPlaylistSnapshot(spotifyPlaylist)
+	if err := playlistStore.SavePlaylist(playlist, tracks); err != nil {
+		return nil, err
+	}
+
+	sub, err := playlistStore.CreateSubscription(&model.Subscription{
+		UserID:          userID,
+		PlaylistID:      playlist.ID,
+		PlaylistOwnerID: playlist.OwnerID,
+		PlaylistName:    playlist.Name,
+		PlaylistVersion: playlist.SnapshotID,
+		Status:          model.SubscriptionActive,
+		NextCheckAt:     &nextCheckAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Unavailable() {
+		glog.Infof("Reactivating subscription to available playlist. userID=%s playlistID=%s", userID, playlist.ID)
+
+		// Changes made while the playlist was unavailable are found by the next check
+		sub.SetStatus(model.SubscriptionActive, util.WallClock.Now())
+		sub.NextCheckAt = &nextCheckAt
+		if err := playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+			return nil, err
+		}
+	}
+
+	return sub, nil
+}
+
+// diffPlaylists returns activities for everything that changed between two snapshots of a playlist. Only
+// added tracks are known for a Legacy previous snapshot.
+func diffPlaylists(prev *model.Playlist, prevTracks []*model.PlaylistTrack, playlist *model.Playlist,
+	tracks []*model.PlaylistTrack, now time.Time) []*model.ActivityData {
+
+	added := model.AddedPlaylistTracks(prevTracks, tracks)
+	if prev.Legacy {
+		added = model.AddedLegacyPlaylistTracks(prevTracks, tracks)
+	}
+
+	var changes []*model.ActivityData
+	for _, track := range added {
+		data := &model.ActivityData{
+			PlaylistID:      playlist.ID,
+			PlaylistOwnerID: playlist.OwnerID,
+			TrackAdded:      &model.TrackAdded{},
+			TrackMetadata:   track.Metadata,
+			ActorUserID:     track.AddedBy,
+		}
+		if track.AddedAt != nil {
+			data.OccuredAt = *track.AddedAt
+		}
+		changes = append(changes, data)
+
+		glog.Infof("New track. playlistID=%s trackID=%s", playlist.ID, track.TrackID)
+	}
+
+	if prev.Legacy {
+		return changes
+	}
+
+	return append(changes, playlistChanges(prev, prevTracks, playlist, tracks, now)...)
+}
+
+// playlistChanges returns activities for changed details and reordered tracks. Only the owner can
+// change a playlist's details, so they're the actor for those, but who reordered tracks isn't known.
+func playlistChanges(prev *model.Playlist, prevTracks []*model.PlaylistTrack, playlist *model.Playlist,
+	tracks []*model.PlaylistTrack, now time.Time) []*model.ActivityData {
+
+	newActivityData := func(ownerActed bool) *model.ActivityData {
+		data := &model.ActivityData{
+			PlaylistID:      playlist.ID,
+			PlaylistOwnerID: playlist.OwnerID,
+			OccuredAt:       now,
+		}
+		if ownerActed {
+			data.ActorUserID = playlist.OwnerID
+		}
+		return data
+	}
+
+	var changes []*model.ActivityData
+	if prev.Name != playlist.Name {
+		data := newActivityData(true)
+		data.PlaylistRenamed = &model.PlaylistRenamed{OldName: prev.Name, NewName: playlist.Name}
+		changes = append(changes, data)
+	}
+	if prev.Description != playlist.Description {
+		data := newActivityData(true)
+		data.PlaylistDescriptionChanged = &model.PlaylistDescriptionChanged{
+			OldDescription: prev.Description,
+			NewDescription: playlist.Description,
+		}
+		changes = append(changes, data)
+	}
+	if prev.Collaborative && !playlist.Collaborative {
+		data := newActivityData(true)
+		data.PlaylistMadeNonCollaborative = &model.PlaylistMadeNonCollaborative{}
+		changes = append(changes, data)
+	}
+	if reordered(trackIDs(prevTracks), trackIDs(tracks)) {
+		data := newActivityData(false)
+		data.PlaylistReordered = &model.PlaylistReordered{}
+		changes = append(changes, data)
+	}
+
+	for _, change := range changes {
+		glog.Infof("Playlist changed. playlistID=%s change=`%s`", playlist.ID, change.UniqueID())
+	}
+
+	return changes
+}
+
+func trackIDs(tracks []*model.PlaylistTrack) []string {
+	ids := make([]string, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.TrackID
+	}
+
+	return ids
+}
+
+// reordered returns true if tracks in both lists appear in a different relative order, ignoring
+// tracks that were added or removed.
+func reordered(prevTrackIDs, trackIDs []string) bool {
+	prev := make(map[string]bool, len(prevTrackIDs))
+	for _, trackID := range prevTrackIDs {
+		prev[trackID] = true
+	}
+	current := make(map[string]bool, len(trackIDs))
+	for _, trackID := range trackIDs {
+		current[trackID] = true
+	}
+
+	var keptPrev, kept []string
+	for _, trackID := range prevTrackIDs {
+		if current[trackID] {
+			keptPrev = append(keptPrev, trackID)
+		}
+	}
+	for _, trackID := range trackIDs {
+		if prev[trackID] {
+			kept = append(kept, trackID)
+		}
+	}
+
+	if len(keptPrev) != len(kept) {
+		// Duplicate tracks were added or removed, which isn't a reorder
+		return false
+	}
+	for i := range kept {
+		if kept[i] != keptPrev[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func trackMetadata(track *spotify.PlaylistTrack) *model.TrackMetadata {
+	metadata := &model.TrackMetadata{
+		TrackID:     spotify.TrackKey(track),
+		Name:        track.Track.Name,
+		ArtistNames: artistNames(track.Track.Arists),
+		URL:         track.Track.ExternalURLs["spotify"], // TODO: fix
+		URI:         track.Track.URI,
+		Episode:     track.Track.IsEpisode(),
+		Local:       track.IsLocal || track.Track.IsLocal,
+	}
+
+	if track.Track.Album != nil {
+		metadata.AlbumName = track.Track.Album.Name
+	} else if track.Track.Show != nil {
+		metadata.AlbumName = track.Track.Show.Name
+	}
+
+	return metadata
+}
+
+func artistNames(artists []*spotify.Artist) []string {
+	names := make([]string, 0, len(artists))
+	for _, artist := range artists {
+		if artist != nil {
+			names = append(names, artist.Name)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,164 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/oauth"
+	"github.com/alecholmes/spotlight/spotify"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	FollowReconcilePeriod = 6 * time.Hour
+
+	reconcileFollowsBatchSize = 20
+)
+
+// ReconcileFollowsJob finds subscriptions to playlists the user has unfollowed in Spotify. They stop being
+// checked until the user either follows the playlist again or unsubscribes, unless the user has chosen to
+// be unsubscribed automatically. Users can also choose to be subscribed to every collaborative playlist
+// they follow.
+type ReconcileFollowsJob struct {
+	oauth         *oauth.OAuth
+	userStore     model.UserStore
+	playlistStore model.PlaylistStore
+}
+
+func NewReconcileFollowsJob(oauth *oauth.OAuth, userStore model.UserStore, playlistStore model.PlaylistStore) *ReconcileFollowsJob {
+	return &ReconcileFollowsJob{
+		oauth:         oauth,
+		userStore:     userStore,
+		playlistStore: playlistStore,
+	}
+}
+
+func (r *ReconcileFollowsJob) Run() error {
+	users, err := r.userStore.ListUsersToReconcileFollows(util.WallClock.Now().Add(-FollowReconcilePeriod), reconcileFollowsBatchSize)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		// One user's failure shouldn't hold up everyone else, so they wait until the next period to be retried
+		if err := r.reconcileFollows(user); err != nil {
+			glog.Errorf("Error reconciling follows. userID=%s error=%v", user.ID, err)
+		}
+		if err := r.userStore.MarkFollowsReconciled(user.ID); err != nil {
+			glog.Errorf("Error marking follows reconciled. userID=%s error=%v", user.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *ReconcileFollowsJob) reconcileFollows(user *model.User) error {
+	accessToken, err := r.oauth.AccessToken(user)
+	if oauth.IsRevoked(err) {
+		// The user's subscriptions aren't checked until they log in again anyway
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	client := spotify.NewSpotifyClient(accessToken)
+
+	playlists, err := client.ListMyPlaylists()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	followed := make(map[model.PlaylistID]bool, len(playlists))
+	for _, playlist := range playlists {
+		followed[model.PlaylistID(playlist.ID)] = true
+	}
+
+	subs, err := r.playlistStore.ListSubscriptionsForUser(user.ID)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if user.AutoSubscribe {
+		if err := r.autoSubscribe(client, user, playlists, subs); err != nil {
+			return err
+		}
+	}
+
+	now := util.WallClock.Now()
+	var changed []*model.Subscription
+	for _, sub := range subs {
+		if user.AutoUnsubscribe && !followed[sub.PlaylistID] {
+			glog.Infof("Unsubscribing from unfollowed playlist. userID=%s playlistID=%s", user.ID, sub.PlaylistID)
+			if _, err := r.playlistStore.DeleteSubscription(sub.Token); err != nil {
+				return errors.Wrap(err, 0)
+			}
+			continue
+		}
+
+		if sub.Unavailable() {
+			continue
+		}
+
+		if !followed[sub.PlaylistID] && sub.UnfollowedAt == nil {
+			glog.Infof("User no longer follows subscribed playlist. userID=%s playlistID=%s", user.ID, sub.PlaylistID)
+			sub.UnfollowedAt = &now
+			changed = append(changed, sub)
+		} else if followed[sub.PlaylistID] && sub.UnfollowedAt != nil {
+			glog.Infof("User follows subscribed playlist again. userID=%s playlistID=%s", user.ID, sub.PlaylistID)
+			sub.UnfollowedAt = nil
+			changed = append(changed, sub)
+		}
+	}
+
+	if len(changed) > 0 {
+		if err := r.playlistStore.UpdateSubscriptions(changed); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	return nil
+}
+
+// autoSubscribe subscribes the user to the collaborative playlists they follow but aren't actively subscribed to,
+// except for those they've unsubscribed from.
+func (r *ReconcileFollowsJob) autoSubscribe(client *spotify.SpotifyClient, user *model.User, playlists []*spotify.Playlist,
+	subs []*model.Subscription) error {
+
+	// Unavailable subscriptions are reactivated if their playlist can be fetched again
+	subscribed := make(map[model.PlaylistID]bool, len(subs))
+	for _, sub := range subs {
+		subscribed[sub.PlaylistID] = !sub.Unavailable()
+	}
+
+	optOuts, err := r.playlistStore.ListSubscriptionOptOuts(user.ID)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	for _, optOut := range optOuts {
+		subscribed[optOut.PlaylistID] = true
+	}
+
+	for _, playlist := range playlists {
+		if !playlist.Collaborative || subscribed[model.PlaylistID(playlist.ID)] {
+			continue
+		}
+
+		// Listed playlists don't include their tracks
+		spotifyPlaylist, err := client.GetPlaylist(playlist.Owner.ID, playlist.ID)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		} else if spotifyPlaylist == nil {
+			continue
+		}
+
+		if _, err := CreateSubscription(r.playlistStore, user.ID, spotifyPlaylist, util.WallClock.Now().Add(SubscriptionCheckPeriod)); err != nil {
+			return errors.Wrap(err, 0)
+		}
+		glog.Infof("Automatically subscribed to playlist. userID=%s playlistID=%s", user.ID, playlist.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package jobs
+
+import (
+	"github.com/alecholmes/spotlight/app/model"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	reencryptBatchSize = 100
+)
+
+// ReencryptTokensJob moves stored OAuth tokens onto the primary encryption key, including any
+// that predate encryption. Once it has caught up, old keys can be removed from the key ring.
+type ReencryptTokensJob struct {
+	reencrypter model.TokenReencrypter
+}
+
+func NewReencryptTokensJob(reencrypter model.TokenReencrypter) *ReencryptTokensJob {
+	return &ReencryptTokensJob{reencrypter: reencrypter}
+}
+
+func (r *ReencryptTokensJob) Run() error {
+	var after model.UserID
+	total, failed := 0, 0
+	for {
+		batch, err := r.reencrypter.ReencryptTokens(after, reencryptBatchSize)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+
+		for userID, err := range batch.Failed {
+			glog.Errorf("Unable to decrypt tokens. userID=%s error=%v", userID, err)
+		}
+
+		total += batch.Reencrypted
+		failed += len(batch.Failed)
+		if batch.Checked < reencryptBatchSize {
+			break
+		}
+		after = batch.LastUserID
+	}
+
+	if total > 0 {
+		glog.Infof("Re-encrypted user tokens. count=%d", total)
+	}
+	if failed > 0 {
+		return errors.Errorf("Unable to re-encrypt tokens for %d users", failed)
+	}
+
+	return nil
+}
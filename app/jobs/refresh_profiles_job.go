@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/oauth"
+	"github.com/alecholmes/spotlight/spotify"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	ProfileRefreshPeriod = 24 * time.Hour
+
+	refreshProfilesBatchSize = 20
+)
+
+// RefreshProfilesJob keeps users' stored names and emails in sync with their Spotify profiles.
+type RefreshProfilesJob struct {
+	oauth     *oauth.OAuth
+	userStore model.UserStore
+}
+
+func NewRefreshProfilesJob(oauth *oauth.OAuth, userStore model.UserStore) *RefreshProfilesJob {
+	return &RefreshProfilesJob{
+		oauth:     oauth,
+		userStore: userStore,
+	}
+}
+
+func (r *RefreshProfilesJob) Run() error {
+	users, err := r.userStore.ListUsersToRefreshProfile(util.WallClock.Now().Add(-ProfileRefreshPeriod), refreshProfilesBatchSize)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		// One user's failure shouldn't hold up everyone else, so they wait until the next period to be retried
+		if err := r.refreshProfile(user); err != nil {
+			glog.Errorf("Error refreshing profile. userID=%s error=%v", user.ID, err)
+			if err := r.userStore.MarkProfileRefreshAttempted(user.ID); err != nil {
+				glog.Errorf("Error marking profile refresh attempt. userID=%s error=%v", user.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *RefreshProfilesJob) refreshProfile(user *model.User) error {
+	accessToken, err := r.oauth.AccessToken(user)
+	if oauth.IsRevoked(err) {
+		// The user is flagged as needing to log in again, and is refreshed when they do
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	profile, err := spotify.NewSpotifyClient(accessToken).GetMyProfile()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if err := r.userStore.UpdateProfile(user.ID, profile.DisplayName, profile.Email); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
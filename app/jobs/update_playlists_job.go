@@ -1,8 +1,6 @@
 package jobs
 
 import (
-	"fmt"
-	"strings"
 	"time"
 
 	"github.com/alecholmes/spotlight/app/model"
@@ -17,6 +15,9 @@ import (
 
 const (
 	SubscriptionCheckPeriod = 10 * time.Second
+
+	// Playlists that fail to update are retried later, so that they don't hold up the others
+	subscriptionRetryPeriod = 5 * time.Minute
 )
 
 type UpdatePlaylistsJob struct {
@@ -51,27 +52,76 @@ func (u *UpdatePlaylistsJob) Run() error {
 	glog.Infof("Updating subs. count=%d", len(subs))
 
 	users := make(map[model.UserID]*model.User)
+	var loadedSubs, failedSubs []*model.Subscription
 	for _, sub := range subs {
-		if user, ok := users[sub.UserID]; !ok {
-			user, err = u.getUser(sub.UserID)
+		if _, ok := users[sub.UserID]; !ok {
+			user, err := u.getUser(sub.UserID)
 			if err != nil {
-				return errors.WrapPrefix(err, fmt.Sprintf("Error getting user `%s`", sub.UserID), 0)
-			} else if user == nil {
-				return errors.WrapPrefix(err, fmt.Sprintf("User `%s` not found`", sub.UserID), 0)
+				glog.Errorf("Error getting user. userID=%s error=%v", sub.UserID, err)
+				failedSubs = append(failedSubs, sub)
+				continue
 			}
 			users[user.ID] = user
 		}
+		loadedSubs = append(loadedSubs, sub)
+	}
+	if len(failedSubs) > 0 {
+		u.deferSubscriptions(failedSubs)
 	}
 
-	for _, sub := range subs {
-		if err := u.updateSubscription(sub, users[sub.UserID]); err != nil {
-			return err
+	// Each playlist is fetched once for all of its due subscriptions
+	var keys []playlistKey
+	subsByPlaylist := make(map[playlistKey][]*model.Subscription)
+	for _, sub := range loadedSubs {
+		key := playlistKey{ownerID: sub.PlaylistOwnerID, playlistID: sub.PlaylistID}
+		if _, ok := subsByPlaylist[key]; !ok {
+			keys = append(keys, key)
+		}
+		subsByPlaylist[key] = append(subsByPlaylist[key], sub)
+	}
+
+	for _, key := range keys {
+		if err := u.updatePlaylist(key, subsByPlaylist[key], users); err != nil {
+			glog.Errorf("Error updating playlist. ownerID=%s playlistID=%s error=%v", key.ownerID, key.playlistID, err)
+			u.deferSubscriptions(subsByPlaylist[key])
 		}
 	}
 
 	return nil
 }
 
+// deferSubscriptions retries due subscriptions later after failing to update them. Otherwise they'd
+// be the first due again, and could keep every other subscription from being checked.
+func (u *UpdatePlaylistsJob) deferSubscriptions(subs []*model.Subscription) {
+	nextCheckAt := util.WallClock.Now().Add(subscriptionRetryPeriod)
+
+	var deferred []*model.Subscription
+	for _, sub := range subs {
+		// The failed update may have saved some changes, e.g. stopping the subscription, so don't overwrite them
+		current, err := u.playlistStore.GetSubscription(sub.Token)
+		if err != nil {
+			glog.Errorf("Error getting subscription to defer. subscriptionToken=%s error=%v", sub.Token, err)
+			continue
+		} else if current == nil {
+			continue
+		}
+
+		current.NextCheckAt = &nextCheckAt
+		deferred = append(deferred, current)
+	}
+
+	if len(deferred) > 0 {
+		if err := u.playlistStore.UpdateSubscriptions(deferred); err != nil {
+			glog.Errorf("Error deferring subscriptions: %v", err)
+		}
+	}
+}
+
+type playlistKey struct {
+	ownerID    model.UserID
+	playlistID model.PlaylistID
+}
+
 func (u *UpdatePlaylistsJob) getUser(userID model.UserID) (*model.User, error) {
 	user, err := u.userStore.GetUser(userID)
 	if err != nil {
@@ -83,102 +133,327 @@ func (u *UpdatePlaylistsJob) getUser(userID model.UserID) (*model.User, error) {
 	return user, nil
 }
 
-func (u *UpdatePlaylistsJob) updateSubscription(sub *model.Subscription, user *model.User) error {
-	glog.Infof("Updating subscription. userID=%s subscriptionToken=%s playlistID=%s", sub.UserID, sub.Token, sub.PlaylistID)
+// updatePlaylist checks a playlist for changes since each of its subscriptions last saw it, and
+// records and notifies subscribers of them.
+func (u *UpdatePlaylistsJob) updatePlaylist(key playlistKey, dueSubs []*model.Subscription, users map[model.UserID]*model.User) error {
+	glog.Infof("Updating playlist. ownerID=%s playlistID=%s dueSubscriptionCount=%d", key.ownerID, key.playlistID, len(dueSubs))
+
+	access := make(map[model.UserID]bool)
+	client, spotifyPlaylist := u.fetchPlaylist(key, dueSubs, users, access)
 
-	accessToken, err := u.oauth.AccessToken(user)
+	// Check subscriptions that aren't due yet too, so that all of a playlist's subscriptions are
+	// checked together from now on
+	subs, err := u.activeSubscriptions(key, users)
 	if err != nil {
-		return errors.Wrap(err, 0)
+		return err
 	}
-	client := spotify.NewSpotifyClient(accessToken)
 
-	playlist, err := client.GetPlaylist(string(sub.PlaylistOwnerID), string(sub.PlaylistID))
-	if err != nil {
+	if spotifyPlaylist == nil {
+		// The due subscribers may be the only ones who can't see the playlist, e.g. one who just resumed
+		// their subscription after losing access, so try everyone else before deciding it's gone
+		client, spotifyPlaylist = u.fetchPlaylist(key, subs, users, access)
+	}
+	if spotifyPlaylist == nil {
+		return u.playlistUnavailable(key, subs, users, access)
+	}
+
+	playlist, tracks := NewPlaylistSnapshot(spotifyPlaylist)
+	if err := u.playlistStore.SavePlaylist(playlist, tracks); err != nil {
 		return errors.Wrap(err, 0)
-	} else if playlist == nil {
-		glog.Infof("Playlist deleted. ownerID=%s playlistID=%s", sub.PlaylistOwnerID, sub.PlaylistID)
+	}
 
-		sub.NextCheckAt = nil
-		if err := u.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+	// Subscriptions can have seen different snapshots, but each one only needs diffing once
+	now := util.WallClock.Now()
+	changesByVersion := make(map[string][]*model.ActivityData)
+	for _, sub := range subs {
+		if _, ok := changesByVersion[sub.PlaylistVersion]; ok || sub.PlaylistVersion == playlist.SnapshotID {
+			continue
+		}
+
+		prevPlaylist, prevTracks, err := u.playlistStore.GetPlaylist(sub.PlaylistID, sub.PlaylistVersion)
+		if err != nil {
 			return errors.Wrap(err, 0)
+		} else if prevPlaylist == nil {
+			glog.Infof("Previous playlist snapshot not stored. playlistID=%s snapshotID=%s", sub.PlaylistID, sub.PlaylistVersion)
+			changesByVersion[sub.PlaylistVersion] = nil
+			continue
 		}
 
-		return nil
+		changesByVersion[sub.PlaylistVersion] = diffPlaylists(prevPlaylist, prevTracks, playlist, tracks, now)
 	}
 
-	nextCheckAt := sub.NextCheckAt.Add(SubscriptionCheckPeriod)
-	sub.NextCheckAt = &nextCheckAt
-	if sub.PlaylistVersion != playlist.SnapshotID {
-		prevTracks := make(map[string]bool)
-		for _, trackID := range sub.PlaylistTrackIDs() {
-			prevTracks[trackID] = true
+	// The playlist was fetched with one subscriber's token, so make sure the others who are about to be told
+	// about its changes can still see it. Those who can't be checked now are left for the next check.
+	var changedSubs []*model.Subscription
+	for _, sub := range subs {
+		if len(changesByVersion[sub.PlaylistVersion]) > 0 {
+			changedSubs = append(changedSubs, sub)
 		}
+	}
+	u.checkAccess(key, changedSubs, users, access)
 
-		var newTracks []*spotify.PlaylistTrack
-		for _, track := range playlist.PlaylistTracks {
-			if !prevTracks[track.Track.ID] {
-				newTracks = append(newTracks, track)
-			}
+	var lostSubs, availableSubs, uncheckedSubs []*model.Subscription
+	for _, sub := range subs {
+		canAccess, checked := access[sub.UserID]
+		if checked && !canAccess {
+			lostSubs = append(lostSubs, sub)
+		} else if !checked && len(changesByVersion[sub.PlaylistVersion]) > 0 {
+			glog.Infof("Skipping subscriber whose access couldn't be checked. userID=%s playlistID=%s", sub.UserID, key.playlistID)
+			uncheckedSubs = append(uncheckedSubs, sub)
+		} else {
+			availableSubs = append(availableSubs, sub)
 		}
-
-		var newActivityData []*model.ActivityData
-		for _, track := range newTracks {
-			newActivityData = append(newActivityData, &model.ActivityData{
-				PlaylistID:      sub.PlaylistID,
-				PlaylistOwnerID: sub.PlaylistOwnerID,
-				TrackAdded:      &model.TrackAdded{},
-				TrackMetadata: &model.TrackMetadata{
-					TrackID:     track.Track.ID,
-					Name:        track.Track.Name,
-					ArtistNames: artistNames(track.Track.Arists),
-					AlbumName:   track.Track.Album.Name,
-					URL:         track.Track.ExternalURLs["spotify"], // TODO: fix
-					URI:         track.Track.URI,
-				},
-				ActorUserID: model.UserID(track.AddedBy.ID),
-				OccuredAt:   track.AddedAt,
-			})
-			glog.Infof("New track. userID=%s subscriptionToken=%s playlistID=%s track=`%v`", sub.UserID, sub.Token, sub.PlaylistID, track)
-		}
-
-		var newActivities []*model.Activity
-		if len(newActivityData) > 0 {
-			if newActivities, err = u.playlistStore.AppendActivities(sub, newActivityData); err != nil {
-				return errors.Wrap(err, 0)
-			}
+	}
+	if len(lostSubs) > 0 {
+		glog.Infof("Subscribers lost access to playlist. ownerID=%s playlistID=%s count=%d", key.ownerID, key.playlistID, len(lostSubs))
+		if err := u.stopSubscriptions(lostSubs, users, model.SubscriptionAccessLost); err != nil {
+			return err
 		}
+	}
+	if len(uncheckedSubs) > 0 {
+		u.deferSubscriptions(uncheckedSubs)
+	}
+	subs = availableSubs
+
+	nextCheckAt := now.Add(SubscriptionCheckPeriod)
+	for _, sub := range subs {
+		changes := changesByVersion[sub.PlaylistVersion]
 
+		sub.PlaylistName = playlist.Name
 		sub.PlaylistVersion = playlist.SnapshotID
-		sub.PlaylistTracks = []byte(strings.Join(spotify.PlaylistTrackIDs(playlist), ","))
+		sub.NextCheckAt = &nextCheckAt
 
-		// For notifications, filter out activities that the current user initiated
-		filteredNewActivities := make([]*model.Activity, 0, len(newActivities))
-		for _, activity := range newActivities {
-			if activity.Data.ActorUserID != user.ID {
-				filteredNewActivities = append(filteredNewActivities, activity)
+		if len(changes) > 0 {
+			if err := u.recordChanges(client, sub, users[sub.UserID], changes); err != nil {
+				return err
 			}
 		}
-		if len(filteredNewActivities) > 0 {
-			if err := u.notifier.SubscriptionUpdate(client, newActivities); err != nil {
-				glog.Errorf("Error notifying: %v", err)
-			}
+	}
+
+	if err := u.playlistStore.UpdateSubscriptions(subs); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if err := u.playlistStore.DeleteUnusedPlaylists(playlist.ID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// fetchPlaylist gets the playlist with the first subscriber's token that works, so one user's revoked
+// authorization or lost access doesn't hold up the others. Whether each user tried could see it is added
+// to access, and users already in it aren't tried again. The playlist is nil if nobody tried could see it.
+func (u *UpdatePlaylistsJob) fetchPlaylist(key playlistKey, subs []*model.Subscription, users map[model.UserID]*model.User,
+	access map[model.UserID]bool) (*spotify.SpotifyClient, *spotify.Playlist) {
+
+	tried := make(map[model.UserID]bool)
+	for _, sub := range subs {
+		user := users[sub.UserID]
+		if _, ok := access[user.ID]; ok || tried[user.ID] || user.ReauthRequiredAt != nil {
+			continue
+		}
+		tried[user.ID] = true
+
+		accessToken, err := u.oauth.AccessToken(user)
+		if oauth.IsRevoked(err) {
+			// The user is emailed by NotifyReauthJob
+			continue
+		} else if err != nil {
+			glog.Errorf("Error getting access token. userID=%s error=%v", user.ID, err)
+			continue
+		}
+		client := spotify.NewSpotifyClient(accessToken)
+
+		playlist, err := client.GetPlaylist(string(key.ownerID), string(key.playlistID))
+		if err != nil {
+			glog.Errorf("Error fetching playlist. userID=%s playlistID=%s error=%v", user.ID, key.playlistID, err)
+			continue
+		} else if playlist == nil {
+			access[user.ID] = false
+			continue
+		}
+
+		access[user.ID] = true
+		return client, playlist
+	}
+
+	return nil, nil
+}
+
+// playlistUnavailable stops the subscriptions of users who couldn't see the playlist. It's only taken to be
+// deleted if none of its subscribers could see it, and those who couldn't be checked are left for the next check.
+func (u *UpdatePlaylistsJob) playlistUnavailable(key playlistKey, subs []*model.Subscription, users map[model.UserID]*model.User,
+	access map[model.UserID]bool) error {
+
+	var lostSubs, uncheckedSubs []*model.Subscription
+	for _, sub := range subs {
+		if _, ok := access[sub.UserID]; ok {
+			lostSubs = append(lostSubs, sub)
 		} else {
-			glog.Infof("Skipping notification since current user owns all activities. userID=%s playlistID=%s", sub.UserID, sub.PlaylistID)
+			uncheckedSubs = append(uncheckedSubs, sub)
+		}
+	}
+
+	if len(uncheckedSubs) > 0 {
+		u.deferSubscriptions(uncheckedSubs)
+	}
+
+	if len(lostSubs) == 0 {
+		glog.Infof("No subscriber can currently fetch playlist. ownerID=%s playlistID=%s", key.ownerID, key.playlistID)
+		return nil
+	} else if len(uncheckedSubs) > 0 {
+		glog.Infof("Subscribers lost access to playlist. ownerID=%s playlistID=%s count=%d", key.ownerID, key.playlistID, len(lostSubs))
+		return u.stopSubscriptions(lostSubs, users, model.SubscriptionAccessLost)
+	}
+
+	glog.Infof("Playlist deleted. ownerID=%s playlistID=%s", key.ownerID, key.playlistID)
+	return u.stopSubscriptions(lostSubs, users, model.SubscriptionPlaylistDeleted)
+}
+
+// checkAccess adds whether each subscriber can see the playlist to access, for those not already in it.
+// Subscribers whose access can't be checked are left out. Each check is a Spotify request, so only
+// subscribers who are about to be told about changes are checked.
+func (u *UpdatePlaylistsJob) checkAccess(key playlistKey, subs []*model.Subscription, users map[model.UserID]*model.User,
+	access map[model.UserID]bool) {
+
+	tried := make(map[model.UserID]bool)
+	for _, sub := range subs {
+		user := users[sub.UserID]
+		if _, ok := access[user.ID]; ok || tried[user.ID] {
+			continue
+		}
+		tried[user.ID] = true
+
+		accessToken, err := u.oauth.AccessToken(user)
+		if oauth.IsRevoked(err) {
+			// The user is emailed by NotifyReauthJob
+			continue
+		} else if err != nil {
+			glog.Errorf("Error getting access token. userID=%s error=%v", user.ID, err)
+			continue
+		}
+
+		canAccess, err := spotify.NewSpotifyClient(accessToken).CanAccessPlaylist(string(key.ownerID), string(key.playlistID))
+		if err != nil {
+			glog.Errorf("Error checking playlist access. userID=%s playlistID=%s error=%v", user.ID, key.playlistID, err)
+			continue
 		}
+		access[user.ID] = canAccess
 	}
+}
+
+// activeSubscriptions returns the playlist's active subscriptions, for users who still follow it and whose authorization hasn't been revoked. Users are loaded into the map as needed.
+func (u *UpdatePlaylistsJob) activeSubscriptions(key playlistKey, users map[model.UserID]*model.User) ([]*model.Subscription, error) {
+	allSubs, err := u.playlistStore.ListSubscriptionsForPlaylist(key.playlistID)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	var subs []*model.Subscription
+	for _, sub := range allSubs {
+		if sub.PlaylistOwnerID != key.ownerID || sub.Status != model.SubscriptionActive || sub.UnfollowedAt != nil {
+			continue
+		}
+
+		user, ok := users[sub.UserID]
+		if !ok {
+			if user, err = u.getUser(sub.UserID); err != nil {
+				return nil, err
+			}
+			users[user.ID] = user
+		}
+
+		if user.ReauthRequiredAt == nil {
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs, nil
+}
+
+// recordChanges appends a subscriber's activities and notifies them.
+func (u *UpdatePlaylistsJob) recordChanges(client *spotify.SpotifyClient, sub *model.Subscription, user *model.User,
+	changes []*model.ActivityData) error {
 
-	if err := u.playlistStore.UpdateSubscriptions([]*model.Subscription{sub}); err != nil {
+	if _, err := u.playlistStore.AppendActivities(sub, changes); err != nil {
 		return errors.Wrap(err, 0)
 	}
 
+	if err := NotifySubscription(u.playlistStore, u.notifier, client, user, sub); err != nil {
+		glog.Errorf("Error notifying: %v", err)
+	}
+
 	return nil
 }
 
-func artistNames(artists []*spotify.Artist) []string {
-	names := make([]string, len(artists))
-	for i, artist := range artists {
-		names[i] = artist.Name
+// NotifySubscription emails a subscriber about the activities recorded for their subscription since they were
+// last notified that pass its notification filter. Activities are held back while the filter is waiting for
+// more tracks, so those can add up across checks. Otherwise they aren't notified again, even if sending fails
+// or the subscription is snoozed.
+func NotifySubscription(playlistStore model.PlaylistStore, notifier *notifiers.Notifier, client *spotify.SpotifyClient,
+	user *model.User, sub *model.Subscription) error {
+
+	pending, err := playlistStore.ListActivityForSubscription(sub.Token, sub.NotifiedActivityID)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	} else if len(pending) == 0 {
+		return nil
+	}
+
+	notifiable, ready := sub.NotifiableActivities(pending)
+	if !ready && len(notifiable) > 0 && !sub.Snoozed(util.WallClock.Now()) {
+		glog.Infof("Holding notification until more tracks are added. userID=%s subscriptionToken=%s pendingCount=%d",
+			user.ID, sub.Token, len(notifiable))
+		return nil
+	}
+
+	var notifyErr error
+	if len(notifiable) > 0 {
+		notifyErr = notifier.SubscriptionUpdate(client, user, sub, notifiable)
+	}
+
+	if err := playlistStore.MarkSubscriptionNotified(sub, pending[len(pending)-1].ID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return notifyErr
+}
+
+// stopSubscriptions stops checking subscriptions to a playlist that has become unavailable, and emails
+// their users once.
+func (u *UpdatePlaylistsJob) stopSubscriptions(subs []*model.Subscription, users map[model.UserID]*model.User,
+	status model.SubscriptionStatus) error {
+
+	now := util.WallClock.Now()
+	for _, sub := range subs {
+		sub.SetStatus(status, now)
+	}
+	if err := u.playlistStore.UpdateSubscriptions(subs); err != nil {
+		return errors.Wrap(err, 0)
 	}
 
-	return names
+	var notified []*model.Subscription
+	for _, sub := range subs {
+		if sub.StatusNotifiedAt != nil {
+			continue
+		}
+
+		glog.Infof("Notifying user that playlist is unavailable. userID=%s playlistID=%s status=%s", sub.UserID, sub.PlaylistID, status)
+		if err := u.notifier.PlaylistUnavailable(users[sub.UserID], sub); err != nil {
+			glog.Errorf("Error notifying: %v", err)
+			continue
+		}
+
+		sub.StatusNotifiedAt = &now
+		notified = append(notified, sub)
+	}
+
+	if len(notified) > 0 {
+		if err := u.playlistStore.UpdateSubscriptions(notified); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	return nil
 }
@@ -40,22 +40,38 @@ func mySQLConnectionString(config *DBConfig) string {
 		config.User, config.Password, config.HostName, config.Port, config.Database)
 }
 
+const (
+	playlistTracksBatchSize = 500
+)
+
 type DBStore struct {
-	db *squalor.DB
+	db      *squalor.DB
+	keyRing *KeyRing
 }
 
 var _ UserStore = &DBStore{}
+var _ TokenReencrypter = &DBStore{}
 var _ PlaylistStore = &DBStore{}
+var _ InvitationStore = &DBStore{}
+var _ SessionStore = &DBStore{}
 
-func NewDBStore(db *sql.DB) *DBStore {
+func NewDBStore(db *sql.DB, keyRing *KeyRing) *DBStore {
 	squalorDB := squalor.NewDB(db)
 
 	squalorDB.MustBindModel("users", &User{})
 	squalorDB.MustBindModel("subscriptions", &Subscription{})
+	squalorDB.MustBindModel("playlists", &Playlist{})
+	squalorDB.MustBindModel("playlist_tracks", &PlaylistTrack{})
 	squalorDB.MustBindModel("activities", &Activity{})
+	squalorDB.MustBindModel("activity_artists", &ActivityArtist{})
+	squalorDB.MustBindModel("invitations", &Invitation{})
+	squalorDB.MustBindModel("sessions", &Session{})
+	squalorDB.MustBindModel("user_profile_changes", &ProfileChange{})
+	squalorDB.MustBindModel("subscription_opt_outs", &SubscriptionOptOut{})
 
 	return &DBStore{
-		db: squalorDB,
+		db:      squalorDB,
+		keyRing: keyRing,
 	}
 }
 
@@ -67,9 +83,14 @@ func (d *DBStore) GetUser(userID UserID) (*User, error) {
 		return nil, errors.Wrap(err, 0)
 	}
 
+	if err := d.decryptTokens(user); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
+// UpsertUser returns the user with plaintext tokens, but only encrypted tokens are persisted.
 func (d *DBStore) UpsertUser(user *User) (*User, error) {
 	now := util.WallClock.Now()
 
@@ -79,25 +100,34 @@ func (d *DBStore) UpsertUser(user *User) (*User, error) {
 	}
 	defer tx.Rollback()
 
-	var updated *User
+	var updated User
 	var existing []User
-	if tx.Select(&existing, "SELECT * FROM users WHERE id = ? FOR UPDATE", user.ID); err != nil {
+	if err := tx.Select(&existing, "SELECT * FROM users WHERE id = ? FOR UPDATE", user.ID); err != nil {
 		return nil, errors.Wrap(err, 0)
 	} else if len(existing) == 0 {
-		updated = user
+		updated = *user
 		updated.CreatedAt = now
 		updated.UpdatedAt = now
+		updated.ProfileRefreshedAt = &now
 
-		if err := tx.Insert(updated); err != nil {
+		if err := d.encryptTokens(&updated); err != nil {
+			return nil, err
+		}
+		if err := tx.Insert(&updated); err != nil {
 			return nil, errors.Wrap(err, 0)
 		}
 	} else {
-		updated := existing[0]
+		updated = existing[0]
 		updated.AccessToken = user.AccessToken
 		updated.RefreshToken = user.RefreshToken
 		updated.ExpiresAt = user.ExpiresAt
+		updated.ReauthRequiredAt = nil
+		updated.ReauthNotifiedAt = nil
 		updated.UpdatedAt = now
 
+		if err := d.encryptTokens(&updated); err != nil {
+			return nil, err
+		}
 		if _, err := tx.Update(&updated); err != nil {
 			return nil, errors.Wrap(err, 0)
 		}
@@ -107,16 +137,315 @@ func (d *DBStore) UpsertUser(user *User) (*User, error) {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	return updated, nil
+	updated.AccessToken = user.AccessToken
+	updated.RefreshToken = user.RefreshToken
+
+	return &updated, nil
+}
+
+func (d *DBStore) MarkReauthRequired(userID UserID) (*User, error) {
+	now := util.WallClock.Now()
+
+	if _, err := d.db.Exec("UPDATE users SET reauth_required_at = ?, updated_at = ? WHERE id = ? AND reauth_required_at IS NULL",
+		now, now, userID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return d.GetUser(userID)
+}
+
+func (d *DBStore) MarkReauthNotified(userID UserID) error {
+	now := util.WallClock.Now()
+
+	if _, err := d.db.Exec("UPDATE users SET reauth_notified_at = ?, updated_at = ? WHERE id = ?",
+		now, now, userID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) ListUsersToNotifyReauth(limit int) ([]*User, error) {
+	query := "SELECT * FROM users WHERE reauth_required_at IS NOT NULL AND reauth_notified_at IS NULL " +
+		"ORDER BY reauth_required_at LIMIT ?"
+
+	var users []*User
+	if err := d.db.Select(&users, query, limit); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		if err := d.decryptTokens(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (d *DBStore) UpdateProfile(userID UserID, name, email string) error {
+	now := util.WallClock.Now()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer tx.Rollback()
+
+	var existing []User
+	if err := tx.Select(&existing, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return errors.Wrap(err, 0)
+	} else if len(existing) == 0 {
+		return nil
+	}
+	user := &existing[0]
+
+	for _, change := range profileChanges(user, name, email) {
+		change.CreatedAt = now
+		if err := tx.Insert(change); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+	applyProfile(user, name, email)
+
+	// Update only the profile columns so the stored (encrypted) tokens are left untouched
+	if _, err := tx.Exec("UPDATE users SET name = ?, email = ?, profile_refreshed_at = ?, updated_at = ? WHERE id = ?",
+		user.Name, user.Email, now, now, userID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) ListProfileChanges(userID UserID) ([]*ProfileChange, error) {
+	var changes []*ProfileChange
+	if err := d.db.Select(&changes, "SELECT * FROM user_profile_changes WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return changes, nil
+}
+
+func (d *DBStore) ListUsersToRefreshProfile(refreshedBefore time.Time, limit int) ([]*User, error) {
+	query := "SELECT * FROM users WHERE reauth_required_at IS NULL " +
+		"AND (profile_refreshed_at IS NULL OR profile_refreshed_at <= ?) " +
+		"ORDER BY profile_refreshed_at LIMIT ?"
+
+	var users []*User
+	if err := d.db.Select(&users, query, refreshedBefore, limit); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		if err := d.decryptTokens(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (d *DBStore) MarkProfileRefreshAttempted(userID UserID) error {
+	now := util.WallClock.Now()
+
+	if _, err := d.db.Exec("UPDATE users SET profile_refreshed_at = ?, updated_at = ? WHERE id = ?",
+		now, now, userID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) ListUsersToReconcileFollows(reconciledBefore time.Time, limit int) ([]*User, error) {
+	query := "SELECT * FROM users WHERE reauth_required_at IS NULL " +
+		"AND (follows_reconciled_at IS NULL OR follows_reconciled_at <= ?) " +
+		"AND (auto_subscribe OR EXISTS (SELECT 1 FROM subscriptions WHERE subscriptions.user_id = users.id)) " +
+		"ORDER BY follows_reconciled_at LIMIT ?"
+
+	var users []*User
+	if err := d.db.Select(&users, query, reconciledBefore, limit); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	for _, user := range users {
+		if err := d.decryptTokens(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (d *DBStore) MarkFollowsReconciled(userID UserID) error {
+	now := util.WallClock.Now()
+
+	if _, err := d.db.Exec("UPDATE users SET follows_reconciled_at = ?, updated_at = ? WHERE id = ?",
+		now, now, userID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) UpdateSubscriptionSettings(userID UserID, autoSubscribe, autoUnsubscribe bool) error {
+	query := "UPDATE users SET auto_subscribe = ?, auto_unsubscribe = ?, follows_reconciled_at = NULL, updated_at = ? " +
+		"WHERE id = ?"
+	if _, err := d.db.Exec(query, autoSubscribe, autoUnsubscribe, util.WallClock.Now(), userID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) DeleteUser(userID UserID) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	defer tx.Rollback()
+
+	var subs []*Subscription
+	if err := tx.Select(&subs, "SELECT * FROM subscriptions WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	if _, err := tx.Exec("DELETE FROM activity_artists WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	if _, err := tx.Exec("DELETE FROM activities WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	if _, err := tx.Exec("DELETE FROM subscriptions WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	if _, err := tx.Exec("DELETE FROM subscription_opt_outs WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	for _, sub := range subs {
+		if err := deleteUnusedPlaylists(tx, sub.PlaylistID); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM invitations WHERE inviter_user_id = ? OR responder_user_id = ?", userID, userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+	if _, err := tx.Exec("DELETE FROM user_profile_changes WHERE user_id = ?", userID); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		return false, errors.Wrap(err, 0)
+	} else if deletedCount, err := res.RowsAffected(); err != nil {
+		return false, errors.Wrap(err, 0)
+	} else if deletedCount == 0 {
+		return false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	return true, nil
+}
+
+// ReencryptTokens re-encrypts the tokens of up to limit users after the given user ID whose tokens are in
+// plaintext or encrypted with a key other than the primary key. Users whose tokens can't be decrypted are
+// skipped, so that they don't hold up everyone else.
+func (d *DBStore) ReencryptTokens(after UserID, limit int) (*ReencryptBatch, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer tx.Rollback()
+
+	var users []*User
+	query := "SELECT * FROM users WHERE id > ? AND (token_key_id IS NULL OR token_key_id <> ?) ORDER BY id LIMIT ? FOR UPDATE"
+	if err := tx.Select(&users, query, after, d.keyRing.PrimaryKeyID(), limit); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	batch := &ReencryptBatch{
+		LastUserID: after,
+		Checked:    len(users),
+		Failed:     make(map[UserID]error),
+	}
+	for _, user := range users {
+		batch.LastUserID = user.ID
+
+		if err := d.decryptTokens(user); err != nil {
+			batch.Failed[user.ID] = err
+			continue
+		}
+		if err := d.encryptTokens(user); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Update(user); err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		batch.Reencrypted++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return batch, nil
+}
+
+func (d *DBStore) encryptTokens(user *User) error {
+	accessToken, err := d.keyRing.Encrypt(user.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	refreshToken, err := d.keyRing.Encrypt(user.RefreshToken)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	keyID := d.keyRing.PrimaryKeyID()
+	user.AccessToken = accessToken
+	user.RefreshToken = refreshToken
+	user.TokenKeyID = &keyID
+
+	return nil
+}
+
+func (d *DBStore) decryptTokens(user *User) error {
+	accessToken, err := d.keyRing.Decrypt(user.AccessToken)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	refreshToken, err := d.keyRing.Decrypt(user.RefreshToken)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	user.AccessToken = accessToken
+	user.RefreshToken = refreshToken
+
+	return nil
 }
 
 func (d *DBStore) CreateSubscription(sub *Subscription) (*Subscription, error) {
 	now := util.WallClock.Now()
 
-	sub.Token = SubscriptionToken(strings.Replace(uuid.NewV4().String(), "-", "", -1))
+	sub.Token = SubscriptionToken(newToken())
 	sub.CreatedAt = now
 	sub.UpdatedAt = now
 
+	if _, err := d.db.Exec("DELETE FROM subscription_opt_outs WHERE user_id = ? AND playlist_id = ?",
+		sub.UserID, sub.PlaylistID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
 	if err := d.db.Insert(sub); duplicateKeyErr(err) {
 		var loaded []*Subscription
 		if err := d.db.Select(&loaded, "SELECT * FROM subscriptions WHERE user_id = ? AND playlist_id = ?",
@@ -130,6 +459,18 @@ func (d *DBStore) CreateSubscription(sub *Subscription) (*Subscription, error) {
 
 	return sub, nil
 }
+
+func (d *DBStore) GetSubscription(token SubscriptionToken) (*Subscription, error) {
+	sub := new(Subscription)
+	if err := d.db.Get(sub, token); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return sub, nil
+}
+
 func (d *DBStore) UpdateSubscriptions(subs []*Subscription) error {
 	now := util.WallClock.Now()
 
@@ -148,12 +489,30 @@ func (d *DBStore) UpdateSubscriptions(subs []*Subscription) error {
 }
 
 func (d *DBStore) DeleteSubscription(token SubscriptionToken) (bool, error) {
+	return d.deleteSubscription(token, false)
+}
+
+func (d *DBStore) OptOutOfSubscription(token SubscriptionToken) (bool, error) {
+	return d.deleteSubscription(token, true)
+}
+
+func (d *DBStore) deleteSubscription(token SubscriptionToken, optOut bool) (bool, error) {
 	tx, err := d.db.Begin()
 	if err != nil {
 		return false, errors.Wrap(err, 0)
 	}
 	defer tx.Rollback()
 
+	sub := new(Subscription)
+	if err := tx.Get(sub, token); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	if _, err := tx.Exec("DELETE FROM activity_artists WHERE subscription_token = ?", token); err != nil {
+		return false, errors.Wrap(err, 0)
+	}
 	if _, err := tx.Exec("DELETE FROM activities WHERE subscription_token = ?", token); err != nil {
 		return false, errors.Wrap(err, 0)
 	}
@@ -167,6 +526,21 @@ func (d *DBStore) DeleteSubscription(token SubscriptionToken) (bool, error) {
 		return false, nil
 	}
 
+	if optOut {
+		optOut := &SubscriptionOptOut{
+			UserID:     sub.UserID,
+			PlaylistID: sub.PlaylistID,
+			CreatedAt:  util.WallClock.Now(),
+		}
+		if err := tx.Insert(optOut); err != nil && !duplicateKeyErr(err) {
+			return false, errors.Wrap(err, 0)
+		}
+	}
+
+	if err := deleteUnusedPlaylists(tx, sub.PlaylistID); err != nil {
+		return false, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return false, errors.Wrap(err, 0)
 	}
@@ -174,6 +548,15 @@ func (d *DBStore) DeleteSubscription(token SubscriptionToken) (bool, error) {
 	return true, nil
 }
 
+func (d *DBStore) ListSubscriptionOptOuts(userID UserID) ([]*SubscriptionOptOut, error) {
+	var optOuts []*SubscriptionOptOut
+	if err := d.db.Select(&optOuts, "SELECT * FROM subscription_opt_outs WHERE user_id = ?", userID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return optOuts, nil
+}
+
 func (d *DBStore) ListSubscriptionsForUser(userID UserID) ([]*Subscription, error) {
 	var subs []*Subscription
 	if err := d.db.Select(&subs, "SELECT * FROM subscriptions WHERE user_id = ? ORDER BY token", userID); err != nil {
@@ -183,16 +566,137 @@ func (d *DBStore) ListSubscriptionsForUser(userID UserID) ([]*Subscription, erro
 	return subs, nil
 }
 
+func (d *DBStore) ListSubscriptionsForPlaylist(playlistID PlaylistID) ([]*Subscription, error) {
+	var subs []*Subscription
+	if err := d.db.Select(&subs, "SELECT * FROM subscriptions WHERE playlist_id = ? ORDER BY token", playlistID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return subs, nil
+}
+
 func (d *DBStore) ListSubscriptionsToCheck(from time.Time, limit int) ([]*Subscription, error) {
+	// Subscriptions are also paused while their user's authorization is revoked or they don't follow the playlist
+	query := "SELECT subscriptions.* FROM subscriptions JOIN users ON users.id = subscriptions.user_id " +
+		"WHERE subscriptions.next_check_at <= ? AND subscriptions.status = ? AND subscriptions.unfollowed_at IS NULL " +
+		"AND users.reauth_required_at IS NULL ORDER BY subscriptions.next_check_at LIMIT ?"
+
 	var subs []*Subscription
-	if err := d.db.Select(&subs, "SELECT * FROM subscriptions WHERE next_check_at <= ? ORDER BY next_check_at LIMIT ?",
-		from, limit); err != nil {
+	if err := d.db.Select(&subs, query, from, SubscriptionActive, limit); err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
 	return subs, nil
 }
 
+func (d *DBStore) SavePlaylist(playlist *Playlist, tracks []*PlaylistTrack) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer tx.Rollback()
+
+	playlist.CreatedAt = util.WallClock.Now()
+	if err := tx.Insert(playlist); duplicateKeyErr(err) {
+		// Snapshots never change, so there's nothing to update
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for start := 0; start < len(tracks); start += playlistTracksBatchSize {
+		end := start + playlistTracksBatchSize
+		if end > len(tracks) {
+			end = len(tracks)
+		}
+
+		batch := make([]interface{}, end-start)
+		for i, track := range tracks[start:end] {
+			batch[i] = track
+		}
+		if err := tx.Insert(batch...); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) GetPlaylist(playlistID PlaylistID, snapshotID string) (*Playlist, []*PlaylistTrack, error) {
+	var playlists []*Playlist
+	if err := d.db.Select(&playlists, "SELECT * FROM playlists WHERE id = ? AND snapshot_id = ?", playlistID, snapshotID); err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	} else if len(playlists) == 0 {
+		return nil, nil, nil
+	}
+
+	var tracks []*PlaylistTrack
+	if err := d.db.Select(&tracks, "SELECT * FROM playlist_tracks WHERE playlist_id = ? AND snapshot_id = ? ORDER BY position",
+		playlistID, snapshotID); err != nil {
+		return nil, nil, errors.Wrap(err, 0)
+	}
+
+	return playlists[0], tracks, nil
+}
+
+func (d *DBStore) ListPlaylistSnapshots(playlistID PlaylistID) ([]*Playlist, error) {
+	var playlists []*Playlist
+	if err := d.db.Select(&playlists, "SELECT * FROM playlists WHERE id = ? ORDER BY created_at DESC, snapshot_id",
+		playlistID); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return playlists, nil
+}
+
+func (d *DBStore) DeleteUnusedPlaylists(playlistID PlaylistID) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	defer tx.Rollback()
+
+	if err := deleteUnusedPlaylists(tx, playlistID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func deleteUnusedPlaylists(tx *squalor.Tx, playlistID PlaylistID) error {
+	createdBefore := util.WallClock.Now().Add(-PlaylistHistoryRetention)
+
+	// Snapshots are kept for the playlist's history, so only expired ones are deleted while it has subscribers
+	var unused []*Playlist
+	query := "SELECT * FROM playlists WHERE id = ? " +
+		"AND snapshot_id NOT IN (SELECT playlist_version FROM subscriptions WHERE playlist_id = ?) " +
+		"AND (created_at < ? OR NOT EXISTS (SELECT 1 FROM subscriptions WHERE playlist_id = ?))"
+	if err := tx.Select(&unused, query, playlistID, playlistID, createdBefore, playlistID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	for _, playlist := range unused {
+		if _, err := tx.Exec("DELETE FROM playlist_tracks WHERE playlist_id = ? AND snapshot_id = ?",
+			playlist.ID, playlist.SnapshotID); err != nil {
+			return errors.Wrap(err, 0)
+		}
+		if _, err := tx.Exec("DELETE FROM playlists WHERE id = ? AND snapshot_id = ?",
+			playlist.ID, playlist.SnapshotID); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	return nil
+}
+
 func (d *DBStore) AppendActivities(sub *Subscription, data []*ActivityData) ([]*Activity, error) {
 	now := util.WallClock.Now()
 
@@ -211,11 +715,20 @@ func (d *DBStore) AppendActivities(sub *Subscription, data []*ActivityData) ([]*
 			Data:              d,
 			CreatedAt:         now,
 		}
+		activity.indexStats()
 		activities[i] = activity
 
-		if err := tx.Insert(activity); err != nil && !duplicateKeyErr(err) {
+		if err := tx.Insert(activity); duplicateKeyErr(err) {
+			continue
+		} else if err != nil {
 			return nil, errors.Wrap(err, 0)
 		}
+
+		for _, artist := range activity.artists() {
+			if err := tx.Insert(artist); err != nil {
+				return nil, errors.Wrap(err, 0)
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -235,6 +748,184 @@ func (d *DBStore) ListActivityForUser(userID UserID, to ActivityID, limit int) (
 	return activities, nil
 }
 
+func (d *DBStore) ListActivityForSubscription(token SubscriptionToken, after ActivityID) ([]*Activity, error) {
+	var activities []*Activity
+	if err := d.db.Select(&activities, "SELECT * FROM activities WHERE subscription_token = ? AND id > ? ORDER BY id",
+		token, after); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return activities, nil
+}
+
+func (d *DBStore) MarkSubscriptionNotified(sub *Subscription, activityID ActivityID) error {
+	// Only this column is written, so that it doesn't race with other changes to the subscription
+	if _, err := d.db.Exec("UPDATE subscriptions SET notified_activity_id = ? WHERE token = ? AND notified_activity_id < ?",
+		activityID, sub.Token, activityID); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if sub.NotifiedActivityID < activityID {
+		sub.NotifiedActivityID = activityID
+	}
+	return nil
+}
+
+func (d *DBStore) GetPlaylistStats(token SubscriptionToken, limit int) (*PlaylistStats, error) {
+	counter := newPlaylistStatsCounter()
+
+	indexed := " FROM activities WHERE subscription_token = ? AND stats_indexed AND track_added "
+	aggregates := []struct {
+		counts map[string]int
+		query  string
+	}{
+		{counter.contributors, "SELECT actor_user_id AS name, COUNT(*) AS count" + indexed + "GROUP BY actor_user_id"},
+		{counter.albums, "SELECT album_name AS name, COUNT(*) AS count" + indexed + "AND album_name != '' GROUP BY album_name"},
+		{counter.artists, "SELECT artist_name AS name, COUNT(*) AS count FROM activity_artists WHERE subscription_token = ? " +
+			"GROUP BY artist_name"},
+	}
+	for _, aggregate := range aggregates {
+		var statCounts []*StatCount
+		if err := d.db.Select(&statCounts, aggregate.query, token); err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		counter.addCounts(aggregate.counts, statCounts)
+	}
+
+	var weeklyCounts []*WeeklyCount
+	query := "SELECT DATE_SUB(DATE(occurred_at), INTERVAL WEEKDAY(occurred_at) DAY) AS week_of, COUNT(*) AS count" +
+		indexed + "GROUP BY week_of"
+	if err := d.db.Select(&weeklyCounts, query, token); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	counter.addWeeks(weeklyCounts)
+
+	// Activities from before stats were indexed are counted from their data
+	var unindexed []*Activity
+	if err := d.db.Select(&unindexed, "SELECT * FROM activities WHERE subscription_token = ? AND NOT stats_indexed",
+		token); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	for _, activity := range unindexed {
+		counter.addActivity(activity)
+	}
+
+	return counter.stats(limit), nil
+}
+
+func (d *DBStore) CreateInvitation(invitation *Invitation) (*Invitation, error) {
+	now := util.WallClock.Now()
+
+	invitation.Token = InvitationToken(newToken())
+	invitation.Status = InvitationPending
+	invitation.CreatedAt = now
+	invitation.UpdatedAt = now
+
+	if err := d.db.Insert(invitation); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return invitation, nil
+}
+
+func (d *DBStore) GetInvitation(token InvitationToken) (*Invitation, error) {
+	invitation := new(Invitation)
+	if err := d.db.Get(invitation, token); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return invitation, nil
+}
+
+func (d *DBStore) UpdateInvitation(invitation *Invitation) error {
+	invitation.UpdatedAt = util.WallClock.Now()
+
+	if _, err := d.db.Update(invitation); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) CreateSession(session *Session) error {
+	if err := d.db.Insert(session); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) GetSession(id SessionID) (*Session, error) {
+	session := new(Session)
+	if err := d.db.Get(session, id); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return session, nil
+}
+
+func (d *DBStore) UpdateSession(session *Session) error {
+	if _, err := d.db.Update(session); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) DeleteSession(id SessionID) error {
+	if _, err := d.db.Exec("DELETE FROM sessions WHERE id = ?", id); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func (d *DBStore) ListSessionsForUser(userID UserID) ([]*Session, error) {
+	var sessions []*Session
+	if err := d.db.Select(&sessions, "SELECT * FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_seen_at DESC",
+		userID, util.WallClock.Now()); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return sessions, nil
+}
+
+func (d *DBStore) DeleteSessionsForUser(userID UserID) (int, error) {
+	res, err := d.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, errors.Wrap(err, 0)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, 0)
+	}
+
+	return int(deleted), nil
+}
+
+func (d *DBStore) DeleteExpiredSessions(now time.Time) (int, error) {
+	res, err := d.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now)
+	if err != nil {
+		return 0, errors.Wrap(err, 0)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, 0)
+	}
+
+	return int(deleted), nil
+}
+
+func newToken() string {
+	return strings.Replace(uuid.NewV4().String(), "-", "", -1)
+}
+
 func duplicateKeyErr(err error) bool {
 	if err == nil {
 		return false
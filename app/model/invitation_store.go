@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+)
+
+type InvitationToken string
+type InvitationStatus string
+
+const (
+	InvitationPending  InvitationStatus = "pending"
+	InvitationAccepted InvitationStatus = "accepted"
+	InvitationDeclined InvitationStatus = "declined"
+)
+
+// Invitation is a persisted invite for someone to subscribe to a playlist. Share links only carry
+// the token, so everything shown to the invitee is resolved from this record rather than the URL.
+type Invitation struct {
+	Token           InvitationToken  `db:"token"`
+	InviterUserID   UserID           `db:"inviter_user_id"`
+	InviteeEmail    string           `db:"invitee_email"`
+	PlaylistID      PlaylistID       `db:"playlist_id"`
+	PlaylistOwnerID UserID           `db:"playlist_owner_id"`
+	PlaylistName    string           `db:"playlist_name"`
+	Status          InvitationStatus `db:"status"`
+	ResponderUserID *UserID          `db:"responder_user_id"`
+	ExpiresAt       time.Time        `db:"expires_at"`
+	RespondedAt     *time.Time       `db:"responded_at"`
+	CreatedAt       time.Time        `db:"created_at"`
+	UpdatedAt       time.Time        `db:"updated_at"`
+}
+
+func (i *Invitation) Expired(now time.Time) bool {
+	return !now.Before(i.ExpiresAt)
+}
+
+type InvitationStore interface {
+	CreateInvitation(invitation *Invitation) (*Invitation, error)
+	GetInvitation(token InvitationToken) (*Invitation, error)
+	UpdateInvitation(invitation *Invitation) error
+}
@@ -0,0 +1,195 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	encryptedPrefix = "enc:v1:"
+	dataKeySize     = 32
+)
+
+type EncryptionKeyConfig struct {
+	ID        string `yaml:"id"`
+	Base64Key string `yaml:"key"`
+}
+
+// EncryptionConfig lists the key encryption keys. New values are encrypted with the primary key,
+// while any listed key can decrypt, so keys can be rotated by adding a new primary and
+// retiring the old key once everything has been re-encrypted.
+type EncryptionConfig struct {
+	PrimaryKeyID string                 `yaml:"primary_key_id"`
+	Keys         []*EncryptionKeyConfig `yaml:"keys"`
+}
+
+// KeyRing does envelope encryption of secrets. Each value is encrypted with its own random data key,
+// and the data key is encrypted with a key encryption key from the ring.
+type KeyRing struct {
+	primaryKeyID string
+	keys         map[string]cipher.AEAD
+}
+
+// GenerateEncryptionKeyConfig returns a new random key encryption key with the given ID.
+func GenerateEncryptionKeyConfig(id string) (*EncryptionKeyConfig, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return &EncryptionKeyConfig{ID: id, Base64Key: base64.StdEncoding.EncodeToString(key)}, nil
+}
+
+func NewKeyRing(config *EncryptionConfig) (*KeyRing, error) {
+	if config == nil {
+		return nil, errors.Errorf("Missing encryption config")
+	}
+
+	keyRing := &KeyRing{
+		primaryKeyID: config.PrimaryKeyID,
+		keys:         make(map[string]cipher.AEAD),
+	}
+
+	for _, keyConfig := range config.Keys {
+		if len(keyConfig.ID) == 0 || strings.Contains(keyConfig.ID, ":") {
+			return nil, errors.Errorf("Invalid encryption key ID `%s`", keyConfig.ID)
+		} else if _, ok := keyRing.keys[keyConfig.ID]; ok {
+			return nil, errors.Errorf("Duplicate encryption key ID `%s`", keyConfig.ID)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(keyConfig.Base64Key)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("Invalid encryption key `%s`", keyConfig.ID), 0)
+		} else if len(key) != 32 {
+			return nil, errors.Errorf("Encryption key `%s` must be 32 bytes, not %d", keyConfig.ID, len(key))
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyRing.keys[keyConfig.ID] = aead
+	}
+
+	if _, ok := keyRing.keys[config.PrimaryKeyID]; !ok {
+		return nil, errors.Errorf("Primary encryption key `%s` not found", config.PrimaryKeyID)
+	}
+
+	return keyRing, nil
+}
+
+func (k *KeyRing) PrimaryKeyID() string {
+	return k.primaryKeyID
+}
+
+// Encrypt returns plaintext encrypted with a new data key, which is itself encrypted with the primary key.
+func (k *KeyRing) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedDataKey, err := seal(k.keys[k.primaryKeyID], dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s:%s:%s", encryptedPrefix, k.primaryKeyID,
+		base64.RawStdEncoding.EncodeToString(encryptedDataKey),
+		base64.RawStdEncoding.EncodeToString(ciphertext)), nil
+}
+
+// Decrypt reverses Encrypt. Values without the encrypted prefix were written before encryption
+// was introduced and are returned unchanged.
+func (k *KeyRing) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.Errorf("Malformed encrypted value")
+	}
+
+	keyAEAD, ok := k.keys[parts[0]]
+	if !ok {
+		return "", errors.Errorf("Unknown encryption key `%s`", parts[0])
+	}
+
+	encryptedDataKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	dataKey, err := open(keyAEAD, encryptedDataKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataAEAD, ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return aead, nil
+}
+
+// seal encrypts plaintext, prefixing the result with a random nonce.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.Errorf("Encrypted value too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Unable to decrypt value", 0)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,17 @@
+CREATE TABLE invitations(
+	token             VARBINARY(50)  NOT NULL,
+	inviter_user_id   VARBINARY(192) NOT NULL,
+	invitee_email     VARCHAR(255)   NOT NULL,
+	playlist_id       VARBINARY(192) NOT NULL,
+	playlist_owner_id VARBINARY(192) NOT NULL,
+	playlist_name     VARCHAR(255)   NOT NULL,
+	status            VARBINARY(20)  NOT NULL,
+	responder_user_id VARBINARY(192),
+	expires_at        DATETIME       NOT NULL,
+	responded_at      DATETIME,
+	created_at        DATETIME       NOT NULL,
+	updated_at        DATETIME       NOT NULL,
+	PRIMARY KEY(token),
+	INDEX(inviter_user_id),
+	INDEX(playlist_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
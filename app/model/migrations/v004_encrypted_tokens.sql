@@ -0,0 +1,4 @@
+ALTER TABLE users
+  MODIFY COLUMN refresh_token BLOB NOT NULL,
+  ADD COLUMN token_key_id VARBINARY(64) AFTER refresh_token,
+  ADD INDEX token_key_id (token_key_id);
@@ -0,0 +1,3 @@
+ALTER TABLE users
+  ADD COLUMN reauth_required_at DATETIME AFTER last_seen_activity_id,
+  ADD COLUMN reauth_notified_at DATETIME AFTER reauth_required_at;
@@ -0,0 +1,12 @@
+CREATE TABLE sessions(
+	id           VARBINARY(64)  NOT NULL,
+	user_id      VARBINARY(192),
+	data         BLOB           NOT NULL,
+	user_agent   VARCHAR(255)   NOT NULL,
+	created_at   DATETIME       NOT NULL,
+	last_seen_at DATETIME       NOT NULL,
+	expires_at   DATETIME       NOT NULL,
+	PRIMARY KEY(id),
+	INDEX(user_id),
+	INDEX(expires_at)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
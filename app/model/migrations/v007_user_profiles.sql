@@ -0,0 +1,14 @@
+ALTER TABLE users
+  ADD COLUMN profile_refreshed_at DATETIME AFTER reauth_notified_at,
+  ADD INDEX(profile_refreshed_at);
+
+CREATE TABLE user_profile_changes(
+	id         BIGINT         NOT NULL AUTO_INCREMENT,
+	user_id    VARBINARY(192) NOT NULL,
+	field      VARBINARY(32)  NOT NULL,
+	old_value  VARCHAR(255)   NOT NULL,
+	new_value  VARCHAR(255)   NOT NULL,
+	created_at DATETIME       NOT NULL,
+	PRIMARY KEY(id),
+	INDEX(user_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions
+  ADD COLUMN playlist_snapshot MEDIUMBLOB AFTER playlist_tracks;
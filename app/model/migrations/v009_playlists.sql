@@ -0,0 +1,61 @@
+CREATE TABLE playlists(
+	id            VARBINARY(192) NOT NULL,
+	snapshot_id   VARBINARY(192) NOT NULL,
+	owner_id      VARBINARY(192) NOT NULL,
+	name          VARCHAR(255)   NOT NULL,
+	description   TEXT           NOT NULL,
+	collaborative BOOLEAN        NOT NULL,
+	legacy        BOOLEAN        NOT NULL DEFAULT FALSE,
+	created_at    DATETIME       NOT NULL,
+	PRIMARY KEY(id, snapshot_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE playlist_tracks(
+	playlist_id VARBINARY(192)  NOT NULL,
+	snapshot_id VARBINARY(192)  NOT NULL,
+	position    INT             NOT NULL,
+	track_id    VARBINARY(1024) NOT NULL,
+	added_at    DATETIME,
+	added_by    VARBINARY(192)  NOT NULL,
+	metadata    BLOB            NOT NULL,
+	PRIMARY KEY(playlist_id, snapshot_id, position)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Subscriptions now reference the snapshot they last saw through playlist_version. So that changes made since
+-- their last check aren't lost, that snapshot is filled from their comma separated track IDs. These legacy
+-- snapshots don't have the playlist's details, track order or who added tracks, so only added tracks are
+-- found by diffing against them.
+INSERT INTO playlists(id, snapshot_id, owner_id, name, description, collaborative, legacy, created_at)
+SELECT playlist_id, playlist_version, MIN(playlist_owner_id), MIN(playlist_name), '', TRUE, TRUE, UTC_TIMESTAMP()
+FROM subscriptions
+GROUP BY playlist_id, playlist_version;
+
+-- Playlists have at most 10,000 tracks
+INSERT INTO playlist_tracks(playlist_id, snapshot_id, position, track_id, added_at, added_by, metadata)
+SELECT legacy.playlist_id, legacy.playlist_version, numbers.n,
+  SUBSTRING_INDEX(SUBSTRING_INDEX(legacy.playlist_tracks, ',', numbers.n + 1), ',', -1), NULL, '', '{}'
+FROM (
+  SELECT playlist_id, playlist_version, MIN(playlist_tracks) AS playlist_tracks
+  FROM subscriptions
+  WHERE playlist_tracks != ''
+  GROUP BY playlist_id, playlist_version
+) legacy
+JOIN (
+  SELECT ones.n + 10 * tens.n + 100 * hundreds.n + 1000 * thousands.n AS n
+  FROM (SELECT 0 AS n UNION ALL SELECT 1 UNION ALL SELECT 2 UNION ALL SELECT 3 UNION ALL SELECT 4 UNION ALL
+        SELECT 5 UNION ALL SELECT 6 UNION ALL SELECT 7 UNION ALL SELECT 8 UNION ALL SELECT 9) ones,
+       (SELECT 0 AS n UNION ALL SELECT 1 UNION ALL SELECT 2 UNION ALL SELECT 3 UNION ALL SELECT 4 UNION ALL
+        SELECT 5 UNION ALL SELECT 6 UNION ALL SELECT 7 UNION ALL SELECT 8 UNION ALL SELECT 9) tens,
+       (SELECT 0 AS n UNION ALL SELECT 1 UNION ALL SELECT 2 UNION ALL SELECT 3 UNION ALL SELECT 4 UNION ALL
+        SELECT 5 UNION ALL SELECT 6 UNION ALL SELECT 7 UNION ALL SELECT 8 UNION ALL SELECT 9) hundreds,
+       (SELECT 0 AS n UNION ALL SELECT 1 UNION ALL SELECT 2 UNION ALL SELECT 3 UNION ALL SELECT 4 UNION ALL
+        SELECT 5 UNION ALL SELECT 6 UNION ALL SELECT 7 UNION ALL SELECT 8 UNION ALL SELECT 9) thousands
+) numbers
+  ON numbers.n <= LENGTH(legacy.playlist_tracks) - LENGTH(REPLACE(legacy.playlist_tracks, ',', ''));
+
+-- Unavailable tracks were listed with empty IDs
+DELETE FROM playlist_tracks WHERE track_id = '';
+
+ALTER TABLE subscriptions
+  DROP COLUMN playlist_tracks,
+  DROP COLUMN playlist_snapshot;
@@ -0,0 +1,20 @@
+-- Stats are aggregated from these columns, since MySQL 5.6 can't query the JSON in activities.data.
+-- Existing activities aren't indexed, so stats for them are computed from their data instead.
+ALTER TABLE activities
+  ADD COLUMN stats_indexed BOOLEAN        NOT NULL DEFAULT FALSE AFTER data,
+  ADD COLUMN track_added   BOOLEAN        NOT NULL DEFAULT FALSE AFTER stats_indexed,
+  ADD COLUMN actor_user_id VARBINARY(192) NOT NULL DEFAULT '' AFTER track_added,
+  ADD COLUMN album_name    VARCHAR(255)   NOT NULL DEFAULT '' AFTER actor_user_id,
+  ADD COLUMN occurred_at   DATETIME AFTER album_name,
+  ADD INDEX subscription_token_stats (subscription_token, stats_indexed, track_added);
+
+CREATE TABLE activity_artists(
+	activity_id        BIGINT         NOT NULL,
+	position           INT            NOT NULL,
+	subscription_token VARBINARY(50)  NOT NULL,
+	user_id            VARBINARY(192) NOT NULL,
+	artist_name        VARCHAR(255)   NOT NULL,
+	PRIMARY KEY(activity_id, position),
+	INDEX(subscription_token),
+	INDEX(user_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
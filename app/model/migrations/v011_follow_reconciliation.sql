@@ -0,0 +1,6 @@
+ALTER TABLE subscriptions
+  ADD COLUMN unfollowed_at DATETIME AFTER next_check_at;
+
+ALTER TABLE users
+  ADD COLUMN follows_reconciled_at DATETIME AFTER profile_refreshed_at,
+  ADD INDEX(follows_reconciled_at);
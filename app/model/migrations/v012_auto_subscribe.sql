@@ -0,0 +1,3 @@
+ALTER TABLE users
+  ADD COLUMN auto_subscribe   BOOLEAN NOT NULL DEFAULT FALSE AFTER follows_reconciled_at,
+  ADD COLUMN auto_unsubscribe BOOLEAN NOT NULL DEFAULT FALSE AFTER auto_subscribe;
@@ -0,0 +1,9 @@
+ALTER TABLE subscriptions
+  ADD COLUMN status             VARBINARY(20) NOT NULL DEFAULT 'active' AFTER playlist_version,
+  ADD COLUMN status_changed_at  DATETIME AFTER status,
+  ADD COLUMN status_notified_at DATETIME AFTER status_changed_at;
+
+-- Subscriptions to deleted playlists used to be stopped by clearing next_check_at
+UPDATE subscriptions
+  SET status = 'playlist_deleted', status_changed_at = updated_at, status_notified_at = updated_at
+  WHERE next_check_at IS NULL;
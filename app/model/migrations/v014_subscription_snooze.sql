@@ -0,0 +1,2 @@
+ALTER TABLE subscriptions
+  ADD COLUMN snoozed_until DATETIME AFTER status_notified_at;
@@ -0,0 +1,5 @@
+-- BLOB columns can't have defaults, so existing subscriptions get the empty filter
+ALTER TABLE subscriptions
+  ADD COLUMN notification_filter BLOB NOT NULL AFTER snoozed_until;
+
+UPDATE subscriptions SET notification_filter = '{}';
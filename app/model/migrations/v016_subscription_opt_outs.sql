@@ -0,0 +1,6 @@
+CREATE TABLE subscription_opt_outs(
+	user_id     VARBINARY(192) NOT NULL,
+	playlist_id VARBINARY(192) NOT NULL,
+	created_at  DATETIME       NOT NULL,
+	PRIMARY KEY(user_id, playlist_id)
+) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
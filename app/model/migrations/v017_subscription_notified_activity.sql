@@ -0,0 +1,6 @@
+-- Existing subscriptions have already been notified about everything recorded for them
+ALTER TABLE subscriptions
+  ADD COLUMN notified_activity_id BIGINT NOT NULL DEFAULT 0 AFTER notification_filter;
+
+UPDATE subscriptions SET notified_activity_id =
+  (SELECT COALESCE(MAX(activities.id), 0) FROM activities WHERE activities.subscription_token = subscriptions.token);
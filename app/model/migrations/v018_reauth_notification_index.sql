@@ -0,0 +1,2 @@
+ALTER TABLE users
+  ADD INDEX(reauth_required_at, reauth_notified_at);
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// NotificationFilter chooses which of a subscription's new activities its user is notified about. Every
+// activity is still recorded. The zero value notifies about everything the user didn't do themselves.
+type NotificationFilter struct {
+	IncludeOwn    bool     `json:"include_own,omitempty"`     // Notify about the user's own activities too
+	ActorUserIDs  []UserID `json:"actor_user_ids,omitempty"`  // Only activities by these users
+	ArtistNames   []string `json:"artist_names,omitempty"`    // Only tracks by these artists, ignoring case
+	MinTrackCount int      `json:"min_track_count,omitempty"` // Only once at least this many tracks are added
+}
+
+var _ sql.Scanner = &NotificationFilter{}
+var _ driver.Valuer = NotificationFilter{}
+
+func (f NotificationFilter) Value() (driver.Value, error) {
+	return json.Marshal(f)
+}
+
+func (f *NotificationFilter) Scan(src interface{}) error {
+	// Fields are omitted when empty, so they mustn't keep their previous values
+	*f = NotificationFilter{}
+
+	if bytes, ok := src.([]byte); !ok {
+		return errors.Errorf("Expected []byte, not %T", src)
+	} else if err := json.Unmarshal(bytes, f); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// NotifiableActivities returns which of the subscription's unnotified activities pass its notification filter,
+// and whether the user should be notified about them yet. Tracks are held back until at least MinTrackCount
+// of them have been added, however many checks that takes, but are sent along with any other activity.
+func (s *Subscription) NotifiableActivities(activities []*Activity) ([]*Activity, bool) {
+	filter := &s.NotificationFilter
+
+	var notifiable []*Activity
+	trackCount := 0
+	for _, activity := range activities {
+		if !filter.matches(s.UserID, activity.Data) {
+			continue
+		}
+
+		notifiable = append(notifiable, activity)
+		if activity.Data.TrackAdded != nil {
+			trackCount++
+		}
+	}
+
+	ready := trackCount >= filter.MinTrackCount || len(notifiable) > trackCount
+	return notifiable, ready
+}
+
+func (f *NotificationFilter) matches(userID UserID, data *ActivityData) bool {
+	if !f.IncludeOwn && data.ActorUserID == userID {
+		return false
+	}
+
+	if len(f.ActorUserIDs) > 0 && !f.matchesActor(data.ActorUserID) {
+		return false
+	}
+
+	// Only tracks have artists, so other activities don't match
+	if len(f.ArtistNames) > 0 && (data.TrackAdded == nil || data.TrackMetadata == nil || !f.matchesArtist(data.TrackMetadata)) {
+		return false
+	}
+
+	return true
+}
+
+func (f *NotificationFilter) matchesActor(actorUserID UserID) bool {
+	for _, filterUserID := range f.ActorUserIDs {
+		if filterUserID == actorUserID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *NotificationFilter) matchesArtist(track *TrackMetadata) bool {
+	for _, filterName := range f.ArtistNames {
+		for _, artistName := range track.ArtistNames {
+			if strings.EqualFold(filterName, artistName) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
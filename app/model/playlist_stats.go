@@ -0,0 +1,148 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Names longer than the activities.album_name and activity_artists.artist_name columns are truncated
+	statsNameLength = 255
+)
+
+type StatCount struct {
+	Name  string `db:"name"`
+	Count int    `db:"count"`
+}
+
+type WeeklyCount struct {
+	WeekOf time.Time `db:"week_of"` // Monday the week starts, in UTC
+	Count  int       `db:"count"`
+}
+
+// PlaylistStats summarizes the tracks added to a playlist. Contributors are named by user ID, or empty
+// if who added the tracks isn't known. Weeks run from the first to the last week with activity, including
+// weeks with none.
+type PlaylistStats struct {
+	TrackCount       int
+	ContributorCount int
+	Contributors     []*StatCount
+	TopArtists       []*StatCount
+	TopAlbums        []*StatCount
+	WeeklyTracks     []*WeeklyCount
+}
+
+// playlistStatsCounter totals stats from SQL aggregates, and from activities that weren't indexed for them.
+type playlistStatsCounter struct {
+	contributors map[string]int
+	artists      map[string]int
+	albums       map[string]int
+	weeks        map[time.Time]int
+}
+
+func newPlaylistStatsCounter() *playlistStatsCounter {
+	return &playlistStatsCounter{
+		contributors: make(map[string]int),
+		artists:      make(map[string]int),
+		albums:       make(map[string]int),
+		weeks:        make(map[time.Time]int),
+	}
+}
+
+func (p *playlistStatsCounter) addCounts(counts map[string]int, statCounts []*StatCount) {
+	for _, statCount := range statCounts {
+		counts[statCount.Name] += statCount.Count
+	}
+}
+
+func (p *playlistStatsCounter) addWeeks(weeklyCounts []*WeeklyCount) {
+	for _, weeklyCount := range weeklyCounts {
+		p.weeks[weekOf(weeklyCount.WeekOf)] += weeklyCount.Count
+	}
+}
+
+// addActivity counts an activity from its data, the same way it would be if it were indexed.
+func (p *playlistStatsCounter) addActivity(activity *Activity) {
+	activity.indexStats()
+	if !activity.TrackAdded {
+		return
+	}
+
+	p.contributors[string(activity.ActorUserID)]++
+	if len(activity.AlbumName) > 0 {
+		p.albums[activity.AlbumName]++
+	}
+	for _, artist := range activity.artists() {
+		p.artists[artist.ArtistName]++
+	}
+	p.weeks[weekOf(*activity.OccurredAt)]++
+}
+
+func (p *playlistStatsCounter) stats(limit int) *PlaylistStats {
+	stats := &PlaylistStats{
+		ContributorCount: len(p.contributors),
+		Contributors:     topCounts(p.contributors, limit),
+		TopArtists:       topCounts(p.artists, limit),
+		TopAlbums:        topCounts(p.albums, limit),
+	}
+
+	for _, count := range p.contributors {
+		stats.TrackCount += count
+	}
+
+	var first, last time.Time
+	for week := range p.weeks {
+		if first.IsZero() || week.Before(first) {
+			first = week
+		}
+		if week.After(last) {
+			last = week
+		}
+	}
+	if !first.IsZero() {
+		for week := first; !week.After(last); week = week.AddDate(0, 0, 7) {
+			stats.WeeklyTracks = append(stats.WeeklyTracks, &WeeklyCount{WeekOf: week, Count: p.weeks[week]})
+		}
+	}
+
+	return stats
+}
+
+// topCounts returns the largest counts, breaking ties by name.
+func topCounts(counts map[string]int, limit int) []*StatCount {
+	statCounts := make([]*StatCount, 0, len(counts))
+	for name, count := range counts {
+		statCounts = append(statCounts, &StatCount{Name: name, Count: count})
+	}
+
+	sort.Slice(statCounts, func(i, j int) bool {
+		if statCounts[i].Count != statCounts[j].Count {
+			return statCounts[i].Count > statCounts[j].Count
+		}
+		return statCounts[i].Name < statCounts[j].Name
+	})
+
+	if len(statCounts) > limit {
+		statCounts = statCounts[:limit]
+	}
+
+	return statCounts
+}
+
+// weekOf returns the Monday starting the week of t, in UTC. This matches MySQL's WEEKDAY.
+func weekOf(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+
+	return string(runes[:n])
+}
@@ -2,11 +2,13 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"math"
-	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -17,30 +19,173 @@ type SubscriptionToken string
 type PlaylistID string
 type ActivityID int64
 
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive          SubscriptionStatus = "active"
+	SubscriptionPlaylistDeleted SubscriptionStatus = "playlist_deleted"
+	SubscriptionAccessLost      SubscriptionStatus = "access_lost" // e.g. the playlist was made private
+	SubscriptionPaused          SubscriptionStatus = "paused"
+)
+
 const (
 	LatestActivityID ActivityID = math.MaxInt64
+
+	// PlaylistHistoryRetention is how long snapshots are kept for a playlist's history once no subscription
+	// refers to them.
+	PlaylistHistoryRetention = 90 * 24 * time.Hour
+
+	maxUniqueTrackIDLength = 64
 )
 
 type Subscription struct {
-	Token           SubscriptionToken `db:"token"`
-	UserID          UserID            `db:"user_id"`
-	PlaylistID      PlaylistID        `db:"playlist_id"`
-	PlaylistOwnerID UserID            `db:"playlist_owner_id"`
-	PlaylistName    string            `db:"playlist_name"`
-	PlaylistVersion string            `db:"playlist_version"`
-	PlaylistTracks  []byte            `db:"playlist_tracks"`
-	NextCheckAt     *time.Time        `db:"next_check_at"`
-	CreatedAt       time.Time         `db:"created_at"`
-	UpdatedAt       time.Time         `db:"updated_at"`
+	Token              SubscriptionToken  `db:"token"`
+	UserID             UserID             `db:"user_id"`
+	PlaylistID         PlaylistID         `db:"playlist_id"`
+	PlaylistOwnerID    UserID             `db:"playlist_owner_id"`
+	PlaylistName       string             `db:"playlist_name"`
+	PlaylistVersion    string             `db:"playlist_version"` // Snapshot ID of the Playlist last seen
+	Status             SubscriptionStatus `db:"status"`
+	StatusChangedAt    *time.Time         `db:"status_changed_at"`
+	StatusNotifiedAt   *time.Time         `db:"status_notified_at"` // When the user was told about the current status
+	SnoozedUntil       *time.Time         `db:"snoozed_until"`      // Activities are still recorded, but not notified
+	NotificationFilter NotificationFilter `db:"notification_filter"`
+	NotifiedActivityID ActivityID         `db:"notified_activity_id"` // Latest activity the user was notified about, or skipped
+	NextCheckAt        *time.Time         `db:"next_check_at"`
+	UnfollowedAt       *time.Time         `db:"unfollowed_at"` // When the user was found to no longer follow the playlist
+	CreatedAt          time.Time          `db:"created_at"`
+	UpdatedAt          time.Time          `db:"updated_at"`
+}
+
+// SetStatus changes the subscription's status. The user hasn't been notified of a new status yet.
+func (s *Subscription) SetStatus(status SubscriptionStatus, now time.Time) {
+	if s.Status == status {
+		return
+	}
+
+	s.Status = status
+	s.StatusChangedAt = &now
+	s.StatusNotifiedAt = nil
+}
+
+// Snoozed returns whether the user doesn't want to be notified about the subscription at the given time.
+func (s *Subscription) Snoozed(now time.Time) bool {
+	return s.SnoozedUntil != nil && now.Before(*s.SnoozedUntil)
+}
+
+// Unavailable returns whether the subscription stopped because its playlist couldn't be fetched.
+func (s *Subscription) Unavailable() bool {
+	return s.Status == SubscriptionPlaylistDeleted || s.Status == SubscriptionAccessLost
+}
+
+// SubscriptionOptOut records that a user unsubscribed from a playlist, so that they aren't subscribed to it
+// again automatically. Subscribing to the playlist again removes it.
+type SubscriptionOptOut struct {
+	UserID     UserID     `db:"user_id"`
+	PlaylistID PlaylistID `db:"playlist_id"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+// Playlist is a playlist's details at a Spotify snapshot. Playlists are shared by all subscriptions to them,
+// and its tracks are the PlaylistTracks with the same playlist and snapshot IDs.
+type Playlist struct {
+	ID            PlaylistID `db:"id"`
+	SnapshotID    string     `db:"snapshot_id"`
+	OwnerID       UserID     `db:"owner_id"`
+	Name          string     `db:"name"`
+	Description   string     `db:"description"`
+	Collaborative bool       `db:"collaborative"`
+	Legacy        bool       `db:"legacy"` // See v009_playlists.sql
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+// PlaylistTrack is an entry in a playlist snapshot. The same track can appear more than once.
+type PlaylistTrack struct {
+	PlaylistID PlaylistID     `db:"playlist_id"`
+	SnapshotID string         `db:"snapshot_id"`
+	Position   int            `db:"position"`
+	TrackID    string         `db:"track_id"` // See spotify.TrackKey
+	AddedAt    *time.Time     `db:"added_at"`
+	AddedBy    UserID         `db:"added_by"`
+	Metadata   *TrackMetadata `db:"metadata"`
+}
+
+// EntryKey identifies the entry within its playlist. Since a track can be added more than once, this
+// includes when and by whom it was added.
+func (p *PlaylistTrack) EntryKey() string {
+	var addedAt string
+	if p.AddedAt != nil {
+		addedAt = p.AddedAt.UTC().Format(time.RFC3339)
+	}
+
+	return fmt.Sprintf("%s|%s|%s", p.TrackID, addedAt, p.AddedBy)
 }
 
-func (s *Subscription) PlaylistTrackIDs() []string {
-	return strings.Split(string(s.PlaylistTracks), ",")
+// AddedLegacyPlaylistTracks is AddedPlaylistTracks for a previous snapshot that's Legacy. Those only have
+// track IDs, so entries are compared by track alone.
+func AddedLegacyPlaylistTracks(prevTracks, tracks []*PlaylistTrack) []*PlaylistTrack {
+	prevEntries := make(map[string]int)
+	for _, track := range prevTracks {
+		prevEntries[track.TrackID]++
+	}
+
+	var added []*PlaylistTrack
+	for _, track := range tracks {
+		if prevEntries[track.TrackID] > 0 {
+			prevEntries[track.TrackID]--
+		} else {
+			added = append(added, track)
+		}
+	}
+
+	return added
+}
+
+// AddedPlaylistTracks returns the entries that aren't in the previous snapshot. Entries are compared as a
+// multiset, so adding a track that's already in the playlist is still noticed. Swapping the arguments
+// gives the removed entries.
+func AddedPlaylistTracks(prevTracks, tracks []*PlaylistTrack) []*PlaylistTrack {
+	prevEntries := make(map[string]int)
+	for _, track := range prevTracks {
+		prevEntries[track.EntryKey()]++
+	}
+
+	var added []*PlaylistTrack
+	for _, track := range tracks {
+		if key := track.EntryKey(); prevEntries[key] > 0 {
+			prevEntries[key]--
+		} else {
+			added = append(added, track)
+		}
+	}
+
+	return added
 }
 
 type TrackAdded struct {
 }
 
+// PlaylistFollowed is recorded for a playlist's subscribers when another user subscribes to it.
+type PlaylistFollowed struct {
+}
+
+type PlaylistRenamed struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
+}
+
+type PlaylistDescriptionChanged struct {
+	OldDescription string `json:"old_description"`
+	NewDescription string `json:"new_description"`
+}
+
+type PlaylistMadeNonCollaborative struct {
+}
+
+// PlaylistReordered means tracks that were already in the playlist changed position.
+type PlaylistReordered struct {
+}
+
 type TrackMetadata struct {
 	TrackID     string   `json:"track_id"`
 	Name        string   `json:"name"`
@@ -48,15 +193,41 @@ type TrackMetadata struct {
 	AlbumName   string   `json:"album_name,omitempty"`
 	URL         string   `json:"url,omitempty"`
 	URI         string   `json:"uri,omitempty"`
+	Episode     bool     `json:"episode,omitempty"`
+	Local       bool     `json:"local,omitempty"`
+}
+
+var _ sql.Scanner = &TrackMetadata{}
+var _ driver.Valuer = &TrackMetadata{}
+
+func (t *TrackMetadata) Value() (driver.Value, error) {
+	return json.Marshal(t)
+}
+
+func (t *TrackMetadata) Scan(src interface{}) error {
+	if bytes, ok := src.([]byte); !ok {
+		return errors.Errorf("Expected []byte, not %T", src)
+	} else if err := json.Unmarshal(bytes, &t); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
 }
 
 type ActivityData struct {
-	PlaylistID      PlaylistID     `json:"playlist_id"`
-	PlaylistOwnerID UserID         `json:"playlist_owner_id"`
-	TrackAdded      *TrackAdded    `json:"track_added,omitempty"`
-	TrackMetadata   *TrackMetadata `json:"track_metadata"`
-	ActorUserID     UserID         `json:"actor_user_id,omitempty"`
-	OccuredAt       time.Time      `json:"occurred_at"`
+	PlaylistID       PlaylistID        `json:"playlist_id"`
+	PlaylistOwnerID  UserID            `json:"playlist_owner_id"`
+	TrackAdded       *TrackAdded       `json:"track_added,omitempty"`
+	PlaylistFollowed *PlaylistFollowed `json:"playlist_followed,omitempty"`
+
+	PlaylistRenamed              *PlaylistRenamed              `json:"playlist_renamed,omitempty"`
+	PlaylistDescriptionChanged   *PlaylistDescriptionChanged   `json:"playlist_description_changed,omitempty"`
+	PlaylistMadeNonCollaborative *PlaylistMadeNonCollaborative `json:"playlist_made_non_collaborative,omitempty"`
+	PlaylistReordered            *PlaylistReordered            `json:"playlist_reordered,omitempty"`
+
+	TrackMetadata *TrackMetadata `json:"track_metadata,omitempty"`
+	ActorUserID   UserID         `json:"actor_user_id,omitempty"`
+	OccuredAt     time.Time      `json:"occurred_at"`
 }
 
 var _ sql.Scanner = &ActivityData{}
@@ -65,16 +236,58 @@ var _ driver.Valuer = &ActivityData{}
 func (a *ActivityData) UniqueID() string {
 	var buf bytes.Buffer
 
+	if a.PlaylistFollowed != nil {
+		// Following the same playlist again, e.g. after unsubscribing, isn't new activity
+		buf.WriteString("playlist_followed:")
+		buf.WriteString(string(a.PlaylistID))
+		buf.WriteString(":")
+		buf.WriteString(string(a.ActorUserID))
+		return buf.String()
+	}
+
+	// A playlist's details can change any number of times, so these are unique per check
+	var playlistChange string
+	switch {
+	case a.PlaylistRenamed != nil:
+		playlistChange = "playlist_renamed"
+	case a.PlaylistDescriptionChanged != nil:
+		playlistChange = "playlist_description_changed"
+	case a.PlaylistMadeNonCollaborative != nil:
+		playlistChange = "playlist_made_non_collaborative"
+	case a.PlaylistReordered != nil:
+		playlistChange = "playlist_reordered"
+	}
+	if len(playlistChange) > 0 {
+		buf.WriteString(fmt.Sprintf("%s:%s:%d", playlistChange, a.PlaylistID, a.OccuredAt.Unix()))
+		return buf.String()
+	}
+
 	if a.TrackAdded != nil {
 		buf.WriteString("track_added")
 	}
 
 	buf.WriteString(":")
-	buf.WriteString(a.TrackMetadata.TrackID)
+	buf.WriteString(uniqueTrackID(a.TrackMetadata.TrackID))
+
+	// The same track can be added more than once
+	if a.TrackAdded != nil {
+		buf.WriteString(fmt.Sprintf(":%d:%s", a.OccuredAt.Unix(), a.ActorUserID))
+	}
 
 	return buf.String()
 }
 
+// uniqueTrackID shortens long track IDs for unique IDs, which have to fit in 255 bytes along with the rest of
+// the unique ID. Local files' IDs are their full URIs, so can be too long.
+func uniqueTrackID(trackID string) string {
+	if len(trackID) <= maxUniqueTrackIDLength {
+		return trackID
+	}
+
+	sum := sha256.Sum256([]byte(trackID))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
 func (a *ActivityData) Value() (driver.Value, error) {
 	return json.Marshal(a)
 }
@@ -89,22 +302,105 @@ func (a *ActivityData) Scan(src interface{}) error {
 	return nil
 }
 
+// Activity is a change to a subscribed playlist. The fields after Data are copied from it so that stats
+// can be aggregated in SQL, and are only set if StatsIndexed is.
 type Activity struct {
 	ID                ActivityID        `db:"id"`
 	UniqueID          string            `db:"unique_id"`
 	SubscriptionToken SubscriptionToken `db:"subscription_token"`
 	UserID            UserID            `db:"user_id"`
 	Data              *ActivityData     `db:"data"`
+	StatsIndexed      bool              `db:"stats_indexed"`
+	TrackAdded        bool              `db:"track_added"`
+	ActorUserID       UserID            `db:"actor_user_id"`
+	AlbumName         string            `db:"album_name"`
+	OccurredAt        *time.Time        `db:"occurred_at"`
 	CreatedAt         time.Time         `db:"created_at"`
 }
 
+// ActivityArtist is one of the artists of the track an activity added.
+type ActivityArtist struct {
+	ActivityID        ActivityID        `db:"activity_id"`
+	Position          int               `db:"position"`
+	SubscriptionToken SubscriptionToken `db:"subscription_token"`
+	UserID            UserID            `db:"user_id"`
+	ArtistName        string            `db:"artist_name"`
+}
+
+// indexStats copies the fields stats are aggregated from out of the activity's data.
+func (a *Activity) indexStats() {
+	a.StatsIndexed = true
+	a.TrackAdded = a.Data.TrackAdded != nil
+	a.ActorUserID = a.Data.ActorUserID
+
+	occurredAt := a.CreatedAt
+	if !a.Data.OccuredAt.IsZero() {
+		occurredAt = a.Data.OccuredAt
+	}
+	a.OccurredAt = &occurredAt
+
+	if a.TrackAdded && a.Data.TrackMetadata != nil {
+		a.AlbumName = truncate(a.Data.TrackMetadata.AlbumName, statsNameLength)
+	}
+}
+
+// artists returns the artists of the track the activity added, once the activity has been inserted.
+func (a *Activity) artists() []*ActivityArtist {
+	if !a.TrackAdded || a.Data.TrackMetadata == nil {
+		return nil
+	}
+
+	var artists []*ActivityArtist
+	seen := make(map[string]bool)
+	for _, name := range a.Data.TrackMetadata.ArtistNames {
+		name = truncate(name, statsNameLength)
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		artists = append(artists, &ActivityArtist{
+			ActivityID:        a.ID,
+			Position:          len(artists),
+			SubscriptionToken: a.SubscriptionToken,
+			UserID:            a.UserID,
+			ArtistName:        name,
+		})
+	}
+
+	return artists
+}
+
 type PlaylistStore interface {
 	CreateSubscription(sub *Subscription) (*Subscription, error)
+	GetSubscription(token SubscriptionToken) (*Subscription, error)
 	UpdateSubscriptions(subs []*Subscription) error
 	DeleteSubscription(token SubscriptionToken) (bool, error)
+	// OptOutOfSubscription deletes a subscription the user chose to stop, recording a SubscriptionOptOut.
+	OptOutOfSubscription(token SubscriptionToken) (bool, error)
+	ListSubscriptionOptOuts(userID UserID) ([]*SubscriptionOptOut, error)
 	ListSubscriptionsForUser(userID UserID) ([]*Subscription, error)
+	ListSubscriptionsForPlaylist(playlistID PlaylistID) ([]*Subscription, error)
+	// ListSubscriptionsToCheck returns active subscriptions that are due to be checked at the given time.
 	ListSubscriptionsToCheck(from time.Time, limit int) ([]*Subscription, error)
 
+	// SavePlaylist stores a playlist snapshot and its tracks, unless that snapshot is already stored.
+	SavePlaylist(playlist *Playlist, tracks []*PlaylistTrack) error
+	// GetPlaylist returns a stored playlist snapshot and its tracks in order, or nil if it isn't stored.
+	GetPlaylist(playlistID PlaylistID, snapshotID string) (*Playlist, []*PlaylistTrack, error)
+	// ListPlaylistSnapshots returns a playlist's stored snapshots without their tracks, newest first.
+	ListPlaylistSnapshots(playlistID PlaylistID) ([]*Playlist, error)
+	// DeleteUnusedPlaylists deletes a playlist's snapshots that no subscription refers to, once they're
+	// older than PlaylistHistoryRetention or nobody subscribes to the playlist any more.
+	DeleteUnusedPlaylists(playlistID PlaylistID) error
+
 	AppendActivities(sub *Subscription, data []*ActivityData) ([]*Activity, error)
 	ListActivityForUser(userID UserID, to ActivityID, limit int) ([]*Activity, error)
+	// ListActivityForSubscription returns a subscription's activities after the given ID, oldest first.
+	ListActivityForSubscription(token SubscriptionToken, after ActivityID) ([]*Activity, error)
+	// MarkSubscriptionNotified records the latest activity that the subscription's user was notified about.
+	MarkSubscriptionNotified(sub *Subscription, activityID ActivityID) error
+	// GetPlaylistStats summarizes the tracks added to a subscription's playlist since it was created.
+	// Lists are limited to the top limit entries.
+	GetPlaylistStats(token SubscriptionToken, limit int) (*PlaylistStats, error)
 }
@@ -0,0 +1,30 @@
+package model
+
+import (
+	"time"
+)
+
+type SessionID string
+
+// Session is the server-side record of an HTTP session. The browser's cookie only holds the ID, so
+// deleting the record signs that browser out.
+type Session struct {
+	ID         SessionID `db:"id"`
+	UserID     *UserID   `db:"user_id"`
+	Data       []byte    `db:"data"`
+	UserAgent  string    `db:"user_agent"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+type SessionStore interface {
+	CreateSession(session *Session) error
+	GetSession(id SessionID) (*Session, error)
+	UpdateSession(session *Session) error
+	DeleteSession(id SessionID) error
+
+	ListSessionsForUser(userID UserID) ([]*Session, error)
+	DeleteSessionsForUser(userID UserID) (int, error)
+	DeleteExpiredSessions(now time.Time) (int, error)
+}
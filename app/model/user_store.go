@@ -8,26 +8,100 @@ import (
 type UserID string
 
 type User struct {
-	ID                 UserID      `db:"id"`
-	AccessToken        string      `db:"access_token"`
-	RefreshToken       string      `db:"refresh_token"`
-	ExpiresAt          time.Time   `db:"expires_at"`
-	Name               string      `db:"name"`
-	Email              string      `db:"email"`
-	LastSeenActivityID *ActivityID `db:"last_seen_activity_id"`
-	CreatedAt          time.Time   `db:"created_at"`
-	UpdatedAt          time.Time   `db:"updated_at"`
+	ID                  UserID      `db:"id"`
+	AccessToken         string      `db:"access_token"`
+	RefreshToken        string      `db:"refresh_token"`
+	TokenKeyID          *string     `db:"token_key_id"`
+	ExpiresAt           time.Time   `db:"expires_at"`
+	Name                string      `db:"name"`
+	Email               string      `db:"email"`
+	LastSeenActivityID  *ActivityID `db:"last_seen_activity_id"`
+	ReauthRequiredAt    *time.Time  `db:"reauth_required_at"`
+	ReauthNotifiedAt    *time.Time  `db:"reauth_notified_at"`
+	ProfileRefreshedAt  *time.Time  `db:"profile_refreshed_at"`
+	FollowsReconciledAt *time.Time  `db:"follows_reconciled_at"`
+	AutoSubscribe       bool        `db:"auto_subscribe"`   // Subscribe to every collaborative playlist the user follows
+	AutoUnsubscribe     bool        `db:"auto_unsubscribe"` // Unsubscribe from playlists the user unfollows
+	CreatedAt           time.Time   `db:"created_at"`
+	UpdatedAt           time.Time   `db:"updated_at"`
+}
+
+type ProfileField string
+
+const (
+	ProfileFieldName  ProfileField = "name"
+	ProfileFieldEmail ProfileField = "email"
+)
+
+// ProfileChange records a user's Spotify profile field changing between refreshes.
+type ProfileChange struct {
+	ID        int64        `db:"id"`
+	UserID    UserID       `db:"user_id"`
+	Field     ProfileField `db:"field"`
+	OldValue  string       `db:"old_value"`
+	NewValue  string       `db:"new_value"`
+	CreatedAt time.Time    `db:"created_at"`
 }
 
 type UserStore interface {
 	GetUser(userID UserID) (*User, error)
+
+	// UpsertUser saves a user's latest tokens. Since new tokens mean the user is authorized, this also
+	// clears any re-authorization state.
 	UpsertUser(user *User) (*User, error)
+
+	// MarkReauthRequired flags that a user's Spotify authorization was revoked. Their subscriptions
+	// aren't checked until they log in again.
+	MarkReauthRequired(userID UserID) (*User, error)
+	MarkReauthNotified(userID UserID) error
+	// ListUsersToNotifyReauth returns users whose authorization was revoked and who haven't been told yet.
+	ListUsersToNotifyReauth(limit int) ([]*User, error)
+
+	// UpdateProfile saves the latest name and email from the user's Spotify profile, recording a
+	// ProfileChange for each field that changed. Empty values are ignored, since Spotify omits
+	// fields the app isn't authorized to read.
+	UpdateProfile(userID UserID, name, email string) error
+	ListProfileChanges(userID UserID) ([]*ProfileChange, error)
+
+	// ListUsersToRefreshProfile returns authorized users whose profile was last refreshed, or failed to be,
+	// before the given time.
+	ListUsersToRefreshProfile(refreshedBefore time.Time, limit int) ([]*User, error)
+	// MarkProfileRefreshAttempted records a failed profile refresh, so that it isn't retried straight away.
+	MarkProfileRefreshAttempted(userID UserID) error
+
+	// ListUsersToReconcileFollows returns authorized users with subscriptions or AutoSubscribe set whose
+	// followed playlists were last compared with their subscriptions before the given time.
+	ListUsersToReconcileFollows(reconciledBefore time.Time, limit int) ([]*User, error)
+	// MarkFollowsReconciled records an attempt to reconcile the user's follows, whether or not it succeeded.
+	MarkFollowsReconciled(userID UserID) error
+
+	// UpdateSubscriptionSettings saves the user's AutoSubscribe and AutoUnsubscribe settings, and has
+	// their follows reconciled soon so that the settings take effect.
+	UpdateSubscriptionSettings(userID UserID, autoSubscribe, autoUnsubscribe bool) error
+
+	// DeleteUser removes a user and everything belonging to them: subscriptions, activities,
+	// invitations and sessions. Returns false if the user did not exist.
+	DeleteUser(userID UserID) (bool, error)
+}
+
+// TokenReencrypter re-encrypts stored OAuth tokens that aren't encrypted with the current primary key.
+type TokenReencrypter interface {
+	ReencryptTokens(after UserID, limit int) (*ReencryptBatch, error)
+}
+
+// ReencryptBatch is the result of re-encrypting the tokens of a batch of users, in user ID order.
+type ReencryptBatch struct {
+	LastUserID  UserID           // The next batch starts after this user
+	Checked     int              // Users whose tokens needed re-encrypting
+	Reencrypted int              // Users whose tokens were re-encrypted
+	Failed      map[UserID]error // Users whose tokens couldn't be decrypted, and were skipped
 }
 
 type InMemoryUserStore struct {
-	mu    sync.Mutex
-	users map[UserID]*User
-	nowFn func() time.Time
+	mu             sync.Mutex
+	users          map[UserID]*User
+	profileChanges []*ProfileChange
+	nowFn          func() time.Time
 }
 
 var _ UserStore = &InMemoryUserStore{}
@@ -55,13 +129,209 @@ func (i *InMemoryUserStore) UpsertUser(user *User) (*User, error) {
 		u.AccessToken = user.AccessToken
 		u.RefreshToken = user.RefreshToken
 		u.ExpiresAt = user.ExpiresAt
+		u.ReauthRequiredAt = nil
+		u.ReauthNotifiedAt = nil
 		u.UpdatedAt = now
 		return u, nil
 	}
 
 	user.CreatedAt = now
 	user.UpdatedAt = now
+	user.ProfileRefreshedAt = &now
 	i.users[user.ID] = user
 
 	return user, nil
 }
+
+func (i *InMemoryUserStore) MarkReauthRequired(userID UserID) (*User, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	u, ok := i.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	now := i.nowFn()
+	if u.ReauthRequiredAt == nil {
+		u.ReauthRequiredAt = &now
+	}
+	u.UpdatedAt = now
+
+	return u, nil
+}
+
+func (i *InMemoryUserStore) MarkReauthNotified(userID UserID) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if u, ok := i.users[userID]; ok {
+		now := i.nowFn()
+		u.ReauthNotifiedAt = &now
+		u.UpdatedAt = now
+	}
+
+	return nil
+}
+
+func (i *InMemoryUserStore) ListUsersToNotifyReauth(limit int) ([]*User, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var users []*User
+	for _, u := range i.users {
+		if len(users) < limit && u.ReauthRequiredAt != nil && u.ReauthNotifiedAt == nil {
+			users = append(users, u)
+		}
+	}
+
+	return users, nil
+}
+
+func (i *InMemoryUserStore) UpdateProfile(userID UserID, name, email string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	u, ok := i.users[userID]
+	if !ok {
+		return nil
+	}
+
+	now := i.nowFn()
+	for _, change := range profileChanges(u, name, email) {
+		change.ID = int64(len(i.profileChanges) + 1)
+		change.CreatedAt = now
+		i.profileChanges = append(i.profileChanges, change)
+	}
+	applyProfile(u, name, email)
+	u.ProfileRefreshedAt = &now
+	u.UpdatedAt = now
+
+	return nil
+}
+
+func (i *InMemoryUserStore) ListProfileChanges(userID UserID) ([]*ProfileChange, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var changes []*ProfileChange
+	for _, change := range i.profileChanges {
+		if change.UserID == userID {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
+
+func (i *InMemoryUserStore) ListUsersToRefreshProfile(refreshedBefore time.Time, limit int) ([]*User, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var users []*User
+	for _, u := range i.users {
+		if len(users) < limit && u.ReauthRequiredAt == nil &&
+			(u.ProfileRefreshedAt == nil || !u.ProfileRefreshedAt.After(refreshedBefore)) {
+			users = append(users, u)
+		}
+	}
+
+	return users, nil
+}
+
+func (i *InMemoryUserStore) MarkProfileRefreshAttempted(userID UserID) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if u, ok := i.users[userID]; ok {
+		now := i.nowFn()
+		u.ProfileRefreshedAt = &now
+		u.UpdatedAt = now
+	}
+
+	return nil
+}
+
+// ListUsersToReconcileFollows returns users regardless of whether they have subscriptions, since those
+// aren't stored here.
+func (i *InMemoryUserStore) ListUsersToReconcileFollows(reconciledBefore time.Time, limit int) ([]*User, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var users []*User
+	for _, u := range i.users {
+		if len(users) < limit && u.ReauthRequiredAt == nil &&
+			(u.FollowsReconciledAt == nil || !u.FollowsReconciledAt.After(reconciledBefore)) {
+			users = append(users, u)
+		}
+	}
+
+	return users, nil
+}
+
+func (i *InMemoryUserStore) MarkFollowsReconciled(userID UserID) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if u, ok := i.users[userID]; ok {
+		now := i.nowFn()
+		u.FollowsReconciledAt = &now
+		u.UpdatedAt = now
+	}
+
+	return nil
+}
+
+func (i *InMemoryUserStore) UpdateSubscriptionSettings(userID UserID, autoSubscribe, autoUnsubscribe bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if u, ok := i.users[userID]; ok {
+		u.AutoSubscribe = autoSubscribe
+		u.AutoUnsubscribe = autoUnsubscribe
+		u.FollowsReconciledAt = nil
+		u.UpdatedAt = i.nowFn()
+	}
+
+	return nil
+}
+
+func (i *InMemoryUserStore) DeleteUser(userID UserID) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	_, ok := i.users[userID]
+	delete(i.users, userID)
+
+	var profileChanges []*ProfileChange
+	for _, change := range i.profileChanges {
+		if change.UserID != userID {
+			profileChanges = append(profileChanges, change)
+		}
+	}
+	i.profileChanges = profileChanges
+
+	return ok, nil
+}
+
+// profileChanges returns the changes that applyProfile would make to the user.
+func profileChanges(user *User, name, email string) []*ProfileChange {
+	var changes []*ProfileChange
+	if len(name) > 0 && name != user.Name {
+		changes = append(changes, &ProfileChange{UserID: user.ID, Field: ProfileFieldName, OldValue: user.Name, NewValue: name})
+	}
+	if len(email) > 0 && email != user.Email {
+		changes = append(changes, &ProfileChange{UserID: user.ID, Field: ProfileFieldEmail, OldValue: user.Email, NewValue: email})
+	}
+
+	return changes
+}
+
+func applyProfile(user *User, name, email string) {
+	if len(name) > 0 {
+		user.Name = name
+	}
+	if len(email) > 0 {
+		user.Email = email
+	}
+}
@@ -1,11 +1,22 @@
 package notifiers
 
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	htmlMime = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";"
+)
+
 type MailerConfig struct {
 	SMTP *SMTPConfig `yaml:"smtp"`
 }
 
 type Mailer interface {
-	SendHTML(from string, recipients, cc, bcc []string, subject string, body string) error
+	SendHTML(from string, recipients, cc, bcc []string, subject string, headers map[string]string, body string) error
 }
 
 func NewMailerFromConfig(config *MailerConfig) Mailer {
@@ -15,3 +26,32 @@ func NewMailerFromConfig(config *MailerConfig) Mailer {
 
 	return NewSESMailer()
 }
+
+// formatHTMLMessage returns a raw message with the given headers, suitable for sending as-is over
+// SMTP. BCC recipients are intentionally not included.
+func formatHTMLMessage(from string, recipients, cc []string, subject string, headers map[string]string, body string) []byte {
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\n", from)
+	fmt.Fprintf(&msg, "To: %s\n", strings.Join(recipients, ", "))
+	if len(cc) > 0 {
+		fmt.Fprintf(&msg, "Cc: %s\n", strings.Join(cc, ", "))
+	}
+	fmt.Fprintf(&msg, "Subject: %s\n", subject)
+
+	// Sort for deterministic output
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		fmt.Fprintf(&msg, "%s: %s\n", name, headers[name])
+	}
+
+	fmt.Fprintf(&msg, "%s\n\n", htmlMime)
+	msg.WriteString(body)
+	msg.WriteString("\n")
+
+	return msg.Bytes()
+}
@@ -3,55 +3,80 @@ package notifiers
 import (
 	"bytes"
 	"fmt"
+	"net/url"
+	"time"
 
 	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/signing"
 	"github.com/alecholmes/spotlight/app/templates"
 	"github.com/alecholmes/spotlight/spotify"
+	"github.com/alecholmes/spotlight/util"
 
 	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	unsubscribeTokenTTL = 90 * 24 * time.Hour
 )
 
 type Notifier struct {
 	mailer     Mailer
+	signer     *signing.Signer
 	appBaseURL string
 	fromEmail  string
+	clock      util.Clock
 }
 
-func NewNotifier(appBaseURL, fromEmail string, mailer Mailer) *Notifier {
+func NewNotifier(appBaseURL, fromEmail string, mailer Mailer, signer *signing.Signer) *Notifier {
 	return &Notifier{
 		mailer:     mailer,
+		signer:     signer,
 		appBaseURL: appBaseURL,
 		fromEmail:  fromEmail,
+		clock:      util.WallClock,
 	}
 }
 
-func (n *Notifier) SubscriptionUpdate(spotifyClient *spotify.SpotifyClient, activities []*model.Activity) error {
-	cachedClient := spotify.NewCachingClient(spotifyClient)
+// SubscriptionUpdate emails a subscriber about activities, unless they snoozed the subscription. Callers
+// choose the activities with the subscription's notification filter.
+func (n *Notifier) SubscriptionUpdate(spotifyClient *spotify.SpotifyClient, user *model.User, sub *model.Subscription,
+	activities []*model.Activity) error {
 
-	loggedInUser, err := n.getLoggedInUser(spotifyClient)
-	if err != nil {
-		return errors.Wrap(err, 0)
+	if sub.Snoozed(n.clock.Now()) {
+		glog.Infof("Skipping notification for snoozed subscription. userID=%s subscriptionToken=%s", user.ID, sub.Token)
+		return nil
+	}
+
+	if len(user.Email) == 0 {
+		return errors.Errorf("No email found for user %s", user.ID)
 	}
 
+	cachedClient := spotify.NewCachingClient(spotifyClient)
+
 	templateData := templates.UpdateSubscriptionEmailData{
-		AppBaseURL: n.appBaseURL,
+		AppBaseURL:     n.appBaseURL,
+		UnsubscribeURL: n.unsubscribeURL(sub.Token),
 	}
 
 	var body bytes.Buffer
 	for _, activity := range activities {
-		actor, err := cachedClient.GetProfile(string(activity.Data.ActorUserID))
-		if err != nil {
-			return errors.Wrap(err, 0)
+		var actor *spotify.PublicProfile
+		if len(activity.Data.ActorUserID) > 0 {
+			var err error
+			if actor, err = cachedClient.GetProfile(string(activity.Data.ActorUserID)); err != nil {
+				return errors.Wrap(err, 0)
+			}
 		}
 		playlist, err := cachedClient.GetPlaylist(string(activity.Data.PlaylistOwnerID), string(activity.Data.PlaylistID))
 		if err != nil {
 			return errors.Wrap(err, 0)
 		}
 		if templateData.Playlist == nil {
-			templateData.Playlist = templates.NewPlaylist(playlist, activity.SubscriptionToken)
+			templateData.Playlist = templates.NewPlaylist(playlist, sub)
 		}
 
-		templateData.Activities = append(templateData.Activities, templates.NewActivity(activity, actor, playlist))
+		templateData.Activities = append(templateData.Activities, templates.NewActivity(activity, actor, playlist, sub))
 	}
 
 	templateData.ActorsDescription = templates.PrettyActorNames(templateData.Activities, 3)
@@ -62,44 +87,93 @@ func (n *Notifier) SubscriptionUpdate(spotifyClient *spotify.SpotifyClient, acti
 
 	subject := "Updates to your Spotify playlist"
 
-	if err := n.mailer.SendHTML(n.fromEmail, []string{loggedInUser.Email}, nil, []string{n.fromEmail}, subject, body.String()); err != nil {
+	// One-click unsubscribe per RFC 8058
+	headers := map[string]string{
+		"List-Unsubscribe":      fmt.Sprintf("<%s>", templateData.UnsubscribeURL),
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+
+	if err := n.mailer.SendHTML(n.fromEmail, []string{user.Email}, nil, []string{n.fromEmail}, subject, headers, body.String()); err != nil {
 		return errors.WrapPrefix(err, "Error sending email", 0)
 	}
 
 	return nil
 }
 
-func (n *Notifier) SharePlaylist(spotifyClient *spotify.SpotifyClient, inviteeEmail string, playlist *spotify.Playlist) error {
-	loggedInUser, err := n.getLoggedInUser(spotifyClient)
-	if err != nil {
+func (n *Notifier) SharePlaylist(inviter *model.User, invitation *model.Invitation, playlist *spotify.Playlist) error {
+	templateData := templates.NewShareEmailData(inviter, invitation, playlist, n.appBaseURL)
+
+	var body bytes.Buffer
+	if err := templates.ShareEmailHTML.Execute(&body, &templateData); err != nil {
 		return errors.Wrap(err, 0)
 	}
 
-	templateData := templates.NewShareEmailData(loggedInUser, playlist, n.appBaseURL)
+	subject := fmt.Sprintf("Follow some music with %s", inviter.Name)
+
+	if err := n.mailer.SendHTML(n.fromEmail, []string{invitation.InviteeEmail}, nil, []string{n.fromEmail}, subject, nil, body.String()); err != nil {
+		return errors.WrapPrefix(err, "Error sending email", 0)
+	}
+
+	return nil
+}
+
+func (n *Notifier) ReauthRequired(user *model.User) error {
+	if len(user.Email) == 0 {
+		return errors.Errorf("No email found for user %s", user.ID)
+	}
+
+	templateData := &templates.ReauthEmailData{
+		Name:       user.Name,
+		SignInURL:  fmt.Sprintf("%s/login?%s", n.appBaseURL, url.Values{"next": {"/subscriptions"}}.Encode()),
+		AppBaseURL: n.appBaseURL,
+	}
 
 	var body bytes.Buffer
-	if err := templates.ShareEmailHTML.Execute(&body, &templateData); err != nil {
+	if err := templates.ReauthEmailHTML.Execute(&body, templateData); err != nil {
 		return errors.Wrap(err, 0)
 	}
 
-	subject := fmt.Sprintf("Follow some music with %s", loggedInUser.DisplayName)
+	subject := "Reconnect Spotlight to Spotify"
 
-	if err := n.mailer.SendHTML(n.fromEmail, []string{inviteeEmail}, nil, []string{n.fromEmail}, subject, body.String()); err != nil {
+	if err := n.mailer.SendHTML(n.fromEmail, []string{user.Email}, nil, nil, subject, nil, body.String()); err != nil {
 		return errors.WrapPrefix(err, "Error sending email", 0)
 	}
 
 	return nil
 }
 
-func (n *Notifier) getLoggedInUser(spotifyClient *spotify.SpotifyClient) (*spotify.PrivateProfile, error) {
-	loggedInUser, err := spotifyClient.GetMyProfile()
-	if err != nil {
-		return nil, errors.Wrap(err, 0)
+// PlaylistUnavailable tells a user that their subscription stopped because its playlist was deleted or
+// they lost access to it.
+func (n *Notifier) PlaylistUnavailable(user *model.User, sub *model.Subscription) error {
+	if len(user.Email) == 0 {
+		return errors.Errorf("No email found for user %s", user.ID)
+	}
+
+	templateData := &templates.PlaylistUnavailableEmailData{
+		Name:             user.Name,
+		PlaylistName:     sub.PlaylistName,
+		Deleted:          sub.Status == model.SubscriptionPlaylistDeleted,
+		SubscriptionsURL: fmt.Sprintf("%s/subscriptions", n.appBaseURL),
+		AppBaseURL:       n.appBaseURL,
 	}
 
-	if len(loggedInUser.Email) == 0 {
-		return nil, errors.Errorf("No email found for user %s", loggedInUser.ID)
+	var body bytes.Buffer
+	if err := templates.PlaylistUnavailableEmailHTML.Execute(&body, templateData); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	subject := fmt.Sprintf("%s is no longer available", sub.PlaylistName)
+
+	if err := n.mailer.SendHTML(n.fromEmail, []string{user.Email}, nil, nil, subject, nil, body.String()); err != nil {
+		return errors.WrapPrefix(err, "Error sending email", 0)
 	}
 
-	return loggedInUser, nil
+	return nil
+}
+
+func (n *Notifier) unsubscribeURL(subToken model.SubscriptionToken) string {
+	query := make(url.Values)
+	query.Set("token", n.signer.Sign(signing.PurposeUnsubscribe, string(subToken), n.clock.Now().Add(unsubscribeTokenTTL)))
+
+	return fmt.Sprintf("%s/subscriptions/unsubscribe?%s", n.appBaseURL, query.Encode())
 }
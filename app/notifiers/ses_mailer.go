@@ -23,7 +23,12 @@ func NewSESMailer() *SESMailer {
 	}
 }
 
-func (s *SESMailer) SendHTML(from string, recipients, cc, bcc []string, subject string, body string) error {
+func (s *SESMailer) SendHTML(from string, recipients, cc, bcc []string, subject string, headers map[string]string, body string) error {
+	// Custom headers can only be set on raw messages
+	if len(headers) > 0 {
+		return s.sendRaw(from, recipients, cc, bcc, subject, headers, body)
+	}
+
 	request := &aws_ses.SendEmailInput{
 		Source: &from,
 		Destination: &aws_ses.Destination{
@@ -46,6 +51,27 @@ func (s *SESMailer) SendHTML(from string, recipients, cc, bcc []string, subject
 	return nil
 }
 
+func (s *SESMailer) sendRaw(from string, recipients, cc, bcc []string, subject string, headers map[string]string, body string) error {
+	var destinations []string
+	destinations = append(destinations, recipients...)
+	destinations = append(destinations, cc...)
+	destinations = append(destinations, bcc...)
+
+	request := &aws_ses.SendRawEmailInput{
+		Source:       &from,
+		Destinations: s.stringPointers(destinations),
+		RawMessage: &aws_ses.RawMessage{
+			Data: formatHTMLMessage(from, recipients, cc, subject, headers, body),
+		},
+	}
+
+	if _, err := s.client.SendRawEmail(request); err != nil {
+		return errors.WrapPrefix(err, "Error sending raw email", 0)
+	}
+
+	return nil
+}
+
 func (s *SESMailer) stringPointers(strs []string) []*string {
 	if len(strs) == 0 {
 		return nil
@@ -53,6 +79,7 @@ func (s *SESMailer) stringPointers(strs []string) []*string {
 
 	ptrs := make([]*string, len(strs))
 	for i, str := range strs {
+		str := str
 		ptrs[i] = &str
 	}
 
@@ -1,17 +1,14 @@
 package notifiers
 
 import (
-	"bytes"
 	"fmt"
 	"net/smtp"
-	"strings"
 
 	"github.com/go-errors/errors"
 )
 
 const (
 	smtpPort = 587
-	htmlMime = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";"
 )
 
 type SMTPConfig struct {
@@ -36,25 +33,15 @@ func NewSMTPMailer(config *SMTPConfig) *SMTPMailer {
 
 var _ Mailer = &SMTPMailer{}
 
-func (s *SMTPMailer) SendHTML(from string, recipients, cc, bcc []string, subject string, body string) error {
-	var smtpBody bytes.Buffer
-
-	fmt.Fprintf(&smtpBody, "From: %s\n", from)
-	fmt.Fprintf(&smtpBody, "To: %s\n", strings.Join(recipients, ", "))
-	if len(cc) > 0 {
-		fmt.Fprintf(&smtpBody, "Cc: %s\n", strings.Join(cc, ", "))
-	}
-	fmt.Fprintf(&smtpBody, "Subject: %s\n", subject)
-	fmt.Fprintf(&smtpBody, "%s\n\n", htmlMime)
-	smtpBody.WriteString(body)
-	smtpBody.WriteString("\n")
+func (s *SMTPMailer) SendHTML(from string, recipients, cc, bcc []string, subject string, headers map[string]string, body string) error {
+	smtpBody := formatHTMLMessage(from, recipients, cc, subject, headers, body)
 
 	allRecipients := recipients
 	if len(bcc) > 0 {
 		allRecipients = append(allRecipients, bcc...)
 	}
 
-	if err := smtp.SendMail(s.hostport, s.auth, from, allRecipients, smtpBody.Bytes()); err != nil {
+	if err := smtp.SendMail(s.hostport, s.auth, from, allRecipients, smtpBody); err != nil {
 		return errors.Wrap(err, 0)
 	}
 
@@ -0,0 +1,38 @@
+package oauth
+
+import (
+	"fmt"
+
+	"github.com/alecholmes/spotlight/app/model"
+
+	"github.com/go-errors/errors"
+)
+
+// RevokedError means a user's refresh token is no longer accepted, usually because they removed the
+// app's access in Spotify. Retrying won't help; the user has to go through the login flow again.
+type RevokedError struct {
+	UserID model.UserID
+	Cause  error
+}
+
+var _ error = &RevokedError{}
+
+func (r *RevokedError) Error() string {
+	return fmt.Sprintf("Spotify authorization revoked. userID=%s cause=`%v`", r.UserID, r.Cause)
+}
+
+// IsRevoked returns true if err is, or wraps, a RevokedError.
+func IsRevoked(err error) bool {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+
+	_, ok := err.(*RevokedError)
+	return ok
+}
+
+// revokedTokenError returns true for refresh failures that mean the grant itself is gone.
+func revokedTokenError(err error) bool {
+	tokenErr, ok := err.(*TokenError)
+	return ok && tokenErr.Code == "invalid_grant"
+}
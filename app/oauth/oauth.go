@@ -2,12 +2,17 @@ package oauth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"net/http"
-	"time"
+	"net/url"
+	"strings"
 
 	"github.com/alecholmes/spotlight/app/model"
 	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/templates"
 	"github.com/alecholmes/spotlight/spotify"
 	"github.com/alecholmes/spotlight/util"
 
@@ -23,71 +28,74 @@ func SpotifyConfig(appBaseURL string, config *Config, scopes []spotify.Scope) *o
 		scopeStrs[i] = string(scope)
 	}
 
+	endpoint := oauth2.Endpoint{
+		AuthURL:  "https://accounts.spotify.com/authorize",
+		TokenURL: "https://accounts.spotify.com/api/token",
+	}
+	if len(config.AuthURL) > 0 {
+		endpoint.AuthURL = config.AuthURL
+	}
+	if len(config.TokenURL) > 0 {
+		endpoint.TokenURL = config.TokenURL
+	}
+
 	return &oauth2.Config{
 		ClientID:     config.ClientID,
 		ClientSecret: config.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.spotify.com/authorize",
-			TokenURL: "https://accounts.spotify.com/api/token",
-		},
-		RedirectURL: fmt.Sprintf("%s/authed", appBaseURL),
-		Scopes:      scopeStrs,
+		Endpoint:     endpoint,
+		RedirectURL:  fmt.Sprintf("%s/authed", appBaseURL),
+		Scopes:       scopeStrs,
 	}
 }
 
+// Config for the OAuth client. ClientSecret may be empty for public clients, which rely on PKCE alone.
+// AuthURL and TokenURL override Spotify's endpoints, e.g. to point at a local fake.
 type Config struct {
 	ClientID     string `yaml:"client_id"`
 	ClientSecret string `yaml:"client_secret"`
+	AuthURL      string `yaml:"auth_url"`
+	TokenURL     string `yaml:"token_url"`
 }
 
 type OAuth struct {
 	config       *oauth2.Config
+	tokens       *TokenManager
+	appBaseURL   *url.URL
 	sessions     *requests.Sessions
 	userStore    model.UserStore
 	errorHandler func(http.ResponseWriter, error)
 	clock        util.Clock
 }
 
-func NewOAuth(config *oauth2.Config, sessions *requests.Sessions, userStore model.UserStore,
-	errorHandler func(http.ResponseWriter, error)) *OAuth {
+func NewOAuth(config *oauth2.Config, tokens *TokenManager, appBaseURL string, sessions *requests.Sessions,
+	userStore model.UserStore, errorHandler func(http.ResponseWriter, error)) (*OAuth, error) {
+
+	baseURL, err := url.Parse(appBaseURL)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Invalid app base URL", 0)
+	}
+
 	return &OAuth{
 		config:       config,
+		tokens:       tokens,
+		appBaseURL:   baseURL,
 		sessions:     sessions,
 		userStore:    userStore,
 		errorHandler: errorHandler,
 		clock:        util.WallClock,
-	}
+	}, nil
 }
 
 func (o *OAuth) BindToMux(mux *mux.Router) {
 	mux.HandleFunc("/authed", requests.WithContext(o.CallbackHandler)).Methods(http.MethodGet)
+	mux.HandleFunc("/login", requests.WithContext(o.MustBeAuthed(o.LoginHandler, o.errorHandler))).Methods(http.MethodGet)
 }
 
+// AccessToken returns a valid access token for the user, refreshing it if needed. If the user's
+// authorization has been revoked then a RevokedError is returned and the user is marked as needing
+// to log in again.
 func (o *OAuth) AccessToken(user *model.User) (string, error) {
-	token := &oauth2.Token{
-		AccessToken:  user.AccessToken,
-		RefreshToken: user.RefreshToken,
-		Expiry:       user.ExpiresAt.In(time.Local),
-	}
-	source := o.config.TokenSource(context.Background(), token)
-
-	// Will this not refresh tokens that are expiring imminently?
-	newToken, err := source.Token()
-	if err != nil {
-		return "", errors.Wrap(err, 0)
-	}
-
-	if newToken.AccessToken != user.AccessToken || newToken.RefreshToken != user.RefreshToken {
-		glog.Infof("Saving new access token. userId=%s", user.ID)
-		user.AccessToken = newToken.AccessToken
-		user.RefreshToken = newToken.RefreshToken
-		user.ExpiresAt = newToken.Expiry.In(time.UTC)
-		if _, err := o.userStore.UpsertUser(user); err != nil {
-			return "", errors.Wrap(err, 0)
-		}
-	}
-
-	return newToken.AccessToken, nil
+	return o.tokens.AccessToken(user)
 }
 
 func (o *OAuth) MustBeAuthed(handler http.HandlerFunc, errorHandler func(http.ResponseWriter, error)) http.HandlerFunc {
@@ -107,8 +115,9 @@ func (o *OAuth) MustBeAuthed(handler http.HandlerFunc, errorHandler func(http.Re
 				return
 			} else if user == nil {
 				glog.Warningf("No persisted credentials found - restarting auth flow. userId=%s", session.SpotifyUserID())
-			} else if _, err := o.AccessToken(user); err != nil {
-				// TODO should handle unauthorized case
+			} else if _, err := o.AccessToken(user); IsRevoked(err) {
+				glog.Infof("Authorization revoked - restarting auth flow. userId=%s", user.ID)
+			} else if err != nil {
 				glog.Infof("Unable to get access token. userId=%s error=`%v`", user.ID, err)
 				errorHandler(rw, err)
 				return
@@ -121,11 +130,7 @@ func (o *OAuth) MustBeAuthed(handler http.HandlerFunc, errorHandler func(http.Re
 
 		if requiresAuth {
 			glog.Infof("Redirecting to oauth flow. requestedURL=`%v`", req.URL)
-
-			state := fmt.Sprintf("%s?%s", req.URL.Path, req.URL.RawQuery) // TODO: better
-
-			rw.Header().Set("Location", o.config.AuthCodeURL(state, oauth2.AccessTypeOffline))
-			rw.WriteHeader(http.StatusFound)
+			o.startAuthFlow(rw, req, session)
 			return
 		}
 
@@ -158,6 +163,19 @@ func (o *OAuth) OptionallyAuthed(handler http.HandlerFunc, errorHandler func(htt
 	}
 }
 
+// LoginHandler sends an authenticated user to the local path in the `next` parameter. This lets pages
+// start the login flow and return to themselves, e.g. before submitting a form.
+func (o *OAuth) LoginHandler(rw http.ResponseWriter, req *http.Request) {
+	next := req.URL.Query().Get("next")
+	if !o.allowedRedirect(next) {
+		glog.Infof("Ignoring disallowed login redirect. next=`%s`", next)
+		next = "/"
+	}
+
+	rw.Header().Set("Location", next)
+	rw.WriteHeader(http.StatusFound)
+}
+
 func (o *OAuth) CallbackHandler(rw http.ResponseWriter, req *http.Request) {
 	session, err := o.sessions.GetSession(req)
 	if err != nil {
@@ -165,15 +183,45 @@ func (o *OAuth) CallbackHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// The state may only be used once, whether or not the flow succeeds
+	expectedState, codeVerifier, redirectLocation := session.TakeOAuthState()
+	if err := session.Save(req, rw); err != nil {
+		o.errorHandler(rw, err)
+		return
+	}
+
 	query := req.URL.Query()
+	state := query.Get("state")
+	if len(expectedState) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(expectedState)) != 1 {
+		glog.Infof("OAuth callback with unexpected state. url=`%v`", req.URL)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	if authErr := query.Get("error"); len(authErr) > 0 {
-		glog.Infof("Auth denied: `%v`", req.URL) // TODO: better error handling, especially for access_denied
-		rw.Header().Set("Location", "/")
-		rw.WriteHeader(http.StatusFound)
+		glog.Infof("Auth denied: `%v`", req.URL)
+		if authErr != "access_denied" {
+			o.errorHandler(rw, errors.Errorf("OAuth authorization error: %s", authErr))
+			return
+		}
+
+		retryURL := "/login"
+		if len(redirectLocation) > 0 {
+			retryURL = fmt.Sprintf("/login?%s", url.Values{"next": {redirectLocation}}.Encode())
+		}
+		viewData := &templates.AuthDeniedViewData{
+			LayoutData: templates.LayoutData{CSRFToken: session.CSRFToken()},
+			RetryURL:   retryURL,
+		}
+
+		rw.WriteHeader(http.StatusForbidden)
+		if err := templates.AuthDeniedView.Execute(rw, viewData); err != nil {
+			glog.Errorf("Unable to render template: %v", err)
+		}
 		return
 	}
 
-	tokens, err := o.config.Exchange(context.Background(), query.Get("code"))
+	tokens, err := exchange(context.Background(), o.config, query.Get("code"), codeVerifier)
 	if err != nil {
 		o.errorHandler(rw, errors.Wrap(err, 0))
 		return
@@ -197,16 +245,86 @@ func (o *OAuth) CallbackHandler(rw http.ResponseWriter, req *http.Request) {
 		o.errorHandler(rw, errors.Wrap(err, 0))
 		return
 	}
+	if err := o.userStore.UpdateProfile(model.UserID(profile.ID), profile.DisplayName, profile.Email); err != nil {
+		o.errorHandler(rw, errors.Wrap(err, 0))
+		return
+	}
+	o.tokens.Store(model.UserID(profile.ID), tokens)
 
 	session.SetSpotifyUserID(profile.ID)
-	session.Save(req, rw)
+	if err := session.Save(req, rw); err != nil {
+		o.errorHandler(rw, err)
+		return
+	}
 
-	// TODO: better validation and logging
-	redirectLocation := req.FormValue("state")
-	if len(redirectLocation) == 0 {
+	if !o.allowedRedirect(redirectLocation) {
+		glog.Infof("Ignoring disallowed post-login redirect. redirect=`%s`", redirectLocation)
 		redirectLocation = "/"
 	}
 
 	rw.Header().Set("Location", redirectLocation)
 	rw.WriteHeader(http.StatusFound)
 }
+
+// startAuthFlow redirects to Spotify's authorization page. A random state nonce is kept in the session
+// along with where to return afterwards, so neither can be forged through the callback URL. The PKCE
+// code verifier is kept there too, binding the authorization code to this browser.
+func (o *OAuth) startAuthFlow(rw http.ResponseWriter, req *http.Request, session *requests.Session) {
+	state, err := newRandomString(32)
+	if err != nil {
+		o.errorHandler(rw, err)
+		return
+	}
+	codeVerifier, err := newRandomString(64)
+	if err != nil {
+		o.errorHandler(rw, err)
+		return
+	}
+
+	// Only GETs can be replayed after logging in
+	redirect := "/"
+	if req.Method == http.MethodGet {
+		redirect = req.URL.RequestURI()
+	}
+
+	session.SetOAuthState(state, codeVerifier, redirect)
+	if err := session.Save(req, rw); err != nil {
+		o.errorHandler(rw, err)
+		return
+	}
+
+	authURL := o.config.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	rw.Header().Set("Location", authURL)
+	rw.WriteHeader(http.StatusFound)
+}
+
+// allowedRedirect returns true if target is on this app's origin. Relative targets must be absolute
+// paths, and anything that a browser could interpret as another host is rejected.
+func (o *OAuth) allowedRedirect(target string) bool {
+	if len(target) == 0 || strings.ContainsAny(target, "\\\r\n") {
+		return false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	if u.IsAbs() || len(u.Host) > 0 {
+		return u.Scheme == o.appBaseURL.Scheme && u.Host == o.appBaseURL.Host
+	}
+
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//")
+}
+
+func newRandomString(size int) (string, error) {
+	raw := make([]byte, size)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,118 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/oauth2"
+)
+
+// TokenError is an error response from the token endpoint, as described in RFC 6749 section 5.2.
+type TokenError struct {
+	StatusCode  int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+var _ error = &TokenError{}
+
+func (t *TokenError) Error() string {
+	return fmt.Sprintf("OAuth token error. status=%d error=`%s` description=`%s`", t.StatusCode, t.Code, t.Description)
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// pkceChallenge returns the S256 code challenge for a code verifier (RFC 7636 section 4.2).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchange trades an authorization code for tokens, proving possession of the PKCE code verifier.
+func exchange(ctx context.Context, config *oauth2.Config, code, codeVerifier string) (*oauth2.Token, error) {
+	return retrieveToken(ctx, config, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.RedirectURL},
+		"code_verifier": {codeVerifier},
+	})
+}
+
+// retrieveToken posts to the token endpoint. Confidential clients authenticate with HTTP basic auth,
+// while public clients (no secret) identify themselves with client_id in the body.
+func retrieveToken(ctx context.Context, config *oauth2.Config, values url.Values) (*oauth2.Token, error) {
+	if len(config.ClientSecret) == 0 {
+		values.Set("client_id", config.ClientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.Endpoint.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(config.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+
+	client := http.DefaultClient
+	if ctxClient, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		client = ctxClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		tokenErr := &TokenError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(body, tokenErr); err != nil {
+			tokenErr.Description = string(body)
+		}
+		return nil, tokenErr
+	}
+
+	tokenResp := new(tokenResponse)
+	if err := json.Unmarshal(body, tokenResp); err != nil {
+		return nil, errors.WrapPrefix(err, "Unable to decode token response", 0)
+	} else if len(tokenResp.AccessToken) == 0 {
+		return nil, errors.Errorf("Token response missing access token")
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  tokenResp.AccessToken,
+		TokenType:    tokenResp.TokenType,
+		RefreshToken: tokenResp.RefreshToken,
+	}
+	if tokenResp.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+
+	// Refresh responses may omit the refresh token if it hasn't changed
+	if len(token.RefreshToken) == 0 {
+		token.RefreshToken = values.Get("refresh_token")
+	}
+
+	return token, nil
+}
@@ -0,0 +1,258 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/util"
+
+	"golang.org/x/oauth2"
+)
+
+// From RFC 7636 appendix B
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// fakeTokenEndpoint is a local token endpoint. It records the last request's form and responds with
+// status and body, or checks PKCE against challenge for authorization code grants if it's set.
+type fakeTokenEndpoint struct {
+	t         *testing.T
+	challenge string
+	status    int
+	body      interface{}
+
+	form     url.Values
+	username string
+	password string
+}
+
+func newFakeTokenEndpoint(t *testing.T) (*fakeTokenEndpoint, *httptest.Server) {
+	endpoint := &fakeTokenEndpoint{
+		t:      t,
+		status: http.StatusOK,
+		body: map[string]interface{}{
+			"access_token": "new-access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		},
+	}
+
+	return endpoint, httptest.NewServer(endpoint)
+}
+
+func (f *fakeTokenEndpoint) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		f.t.Errorf("Expected POST, got %s", req.Method)
+	}
+	if err := req.ParseForm(); err != nil {
+		f.t.Fatalf("Unable to parse form: %v", err)
+	}
+	f.form = req.PostForm
+	f.username, f.password, _ = req.BasicAuth()
+
+	if f.form.Get("grant_type") == "authorization_code" && len(f.challenge) > 0 {
+		sum := sha256.Sum256([]byte(f.form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != f.challenge {
+			rw.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE mismatch"})
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(f.status)
+	if body, ok := f.body.(string); ok {
+		rw.Write([]byte(body))
+	} else {
+		json.NewEncoder(rw).Encode(f.body)
+	}
+}
+
+func testConfig(server *httptest.Server, clientSecret string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: clientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: server.URL},
+		RedirectURL:  "http://localhost/authed",
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	if challenge := pkceChallenge(testCodeVerifier); challenge != testCodeChallenge {
+		t.Errorf("Expected challenge %s, got %s", testCodeChallenge, challenge)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	endpoint, server := newFakeTokenEndpoint(t)
+	defer server.Close()
+	endpoint.challenge = testCodeChallenge
+
+	token, err := exchange(context.Background(), testConfig(server, ""), "code", testCodeVerifier)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if token.AccessToken != "new-access" {
+		t.Errorf("Expected access token new-access, got %s", token.AccessToken)
+	}
+	if token.Expiry.Before(time.Now().Add(59 * time.Minute)) {
+		t.Errorf("Expected expiry in an hour, got %v", token.Expiry)
+	}
+
+	expected := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "code",
+		"redirect_uri":  "http://localhost/authed",
+		"code_verifier": testCodeVerifier,
+		"client_id":     "client", // Public clients identify themselves in the body
+	}
+	for key, value := range expected {
+		if actual := endpoint.form.Get(key); actual != value {
+			t.Errorf("Expected %s=%s, got %s", key, value, actual)
+		}
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	endpoint, server := newFakeTokenEndpoint(t)
+	defer server.Close()
+	endpoint.challenge = testCodeChallenge
+
+	_, err := exchange(context.Background(), testConfig(server, ""), "code", "wrong-verifier")
+	if tokenErr, ok := err.(*TokenError); !ok || tokenErr.Code != "invalid_grant" {
+		t.Errorf("Expected invalid_grant TokenError, got %v", err)
+	}
+}
+
+func TestRetrieveTokenErrors(t *testing.T) {
+	endpoint, server := newFakeTokenEndpoint(t)
+	defer server.Close()
+
+	endpoint.status = http.StatusBadRequest
+	endpoint.body = map[string]string{"error": "invalid_request", "error_description": "Missing code"}
+	_, err := retrieveToken(context.Background(), testConfig(server, ""), url.Values{"grant_type": {"authorization_code"}})
+	if tokenErr, ok := err.(*TokenError); !ok {
+		t.Errorf("Expected TokenError, got %v", err)
+	} else if tokenErr.StatusCode != http.StatusBadRequest || tokenErr.Code != "invalid_request" || tokenErr.Description != "Missing code" {
+		t.Errorf("Unexpected TokenError: %+v", tokenErr)
+	}
+
+	// Bodies that aren't JSON are kept as the description
+	endpoint.status = http.StatusBadGateway
+	endpoint.body = "Bad gateway"
+	_, err = retrieveToken(context.Background(), testConfig(server, ""), url.Values{"grant_type": {"authorization_code"}})
+	if tokenErr, ok := err.(*TokenError); !ok {
+		t.Errorf("Expected TokenError, got %v", err)
+	} else if tokenErr.StatusCode != http.StatusBadGateway || tokenErr.Code != "" || tokenErr.Description != "Bad gateway" {
+		t.Errorf("Unexpected TokenError: %+v", tokenErr)
+	}
+}
+
+func newTestUser(t *testing.T, userStore model.UserStore) *model.User {
+	user, err := userStore.UpsertUser(&model.User{
+		ID:           model.UserID("user"),
+		AccessToken:  "old-access",
+		RefreshToken: "old-refresh",
+		ExpiresAt:    time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("Unable to create user: %v", err)
+	}
+
+	return user
+}
+
+func TestAccessTokenRefreshes(t *testing.T) {
+	endpoint, server := newFakeTokenEndpoint(t)
+	defer server.Close()
+
+	userStore := model.NewInMemoryUserStore()
+	user := newTestUser(t, userStore)
+
+	tokens := NewTokenManager(testConfig(server, "secret"), userStore)
+	accessToken, err := tokens.AccessToken(user)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if accessToken != "new-access" {
+		t.Errorf("Expected access token new-access, got %s", accessToken)
+	}
+
+	if grantType := endpoint.form.Get("grant_type"); grantType != "refresh_token" {
+		t.Errorf("Expected refresh_token grant, got %s", grantType)
+	}
+	if refreshToken := endpoint.form.Get("refresh_token"); refreshToken != "old-refresh" {
+		t.Errorf("Expected refresh token old-refresh, got %s", refreshToken)
+	}
+	if endpoint.username != "client" || endpoint.password != "secret" {
+		t.Errorf("Expected basic auth for confidential client, got %s:%s", endpoint.username, endpoint.password)
+	}
+
+	// The response didn't include a refresh token, so the old one is kept
+	stored, err := userStore.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stored.AccessToken != "new-access" || stored.RefreshToken != "old-refresh" {
+		t.Errorf("Unexpected stored tokens. access=%s refresh=%s", stored.AccessToken, stored.RefreshToken)
+	}
+}
+
+func TestAccessTokenInvalidGrantRevokes(t *testing.T) {
+	endpoint, server := newFakeTokenEndpoint(t)
+	defer server.Close()
+	endpoint.status = http.StatusBadRequest
+	endpoint.body = map[string]string{"error": "invalid_grant", "error_description": "Refresh token revoked"}
+
+	userStore := model.NewInMemoryUserStore()
+	user := newTestUser(t, userStore)
+
+	tokens := NewTokenManager(testConfig(server, "secret"), userStore)
+	if _, err := tokens.AccessToken(user); !IsRevoked(err) {
+		t.Fatalf("Expected RevokedError, got %v", err)
+	}
+
+	stored, err := userStore.GetUser(user.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stored.ReauthRequiredAt == nil {
+		t.Errorf("Expected user to require re-authorization")
+	}
+	if _, ok := tokens.tokens[user.ID]; ok {
+		t.Errorf("Expected revoked user's token to be forgotten")
+	}
+}
+
+func TestTokensEvictedOnceStale(t *testing.T) {
+	now := time.Now()
+	tokens := NewTokenManager(&oauth2.Config{}, model.NewInMemoryUserStore())
+	tokens.clock = &util.FnClock{NowFn: func() time.Time { return now }}
+
+	tokens.Store(model.UserID("stale"), &oauth2.Token{AccessToken: "stale", Expiry: now.Add(time.Hour)})
+	now = now.Add(time.Hour)
+	tokens.Store(model.UserID("fresh"), &oauth2.Token{AccessToken: "fresh", Expiry: now.Add(time.Hour)})
+
+	if _, ok := tokens.tokens[model.UserID("stale")]; ok {
+		t.Errorf("Expected stale token to be evicted")
+	}
+	if _, ok := tokens.tokens[model.UserID("fresh")]; !ok {
+		t.Errorf("Expected fresh token to be cached")
+	}
+
+	tokens.Forget(model.UserID("fresh"))
+	if len(tokens.tokens) != 0 {
+		t.Errorf("Expected no cached tokens, got %d", len(tokens.tokens))
+	}
+}
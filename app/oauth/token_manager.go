@@ -0,0 +1,199 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Tokens expiring within this window are refreshed early, so callers never get a token
+	// that expires mid-request.
+	tokenExpirySkew = 5 * time.Minute
+)
+
+type refreshCall struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+// TokenManager hands out access tokens per user. Valid tokens are cached in-process until they're no
+// longer fresh, and concurrent refreshes for the same user are collapsed into one request so they don't
+// race on the stored tokens.
+type TokenManager struct {
+	config    *oauth2.Config
+	userStore model.UserStore
+	skew      time.Duration
+	clock     util.Clock
+
+	mu        sync.Mutex
+	tokens    map[model.UserID]*oauth2.Token
+	inflight  map[model.UserID]*refreshCall
+	lastSweep time.Time
+}
+
+func NewTokenManager(config *oauth2.Config, userStore model.UserStore) *TokenManager {
+	return &TokenManager{
+		config:    config,
+		userStore: userStore,
+		skew:      tokenExpirySkew,
+		clock:     util.WallClock,
+		tokens:    make(map[model.UserID]*oauth2.Token),
+		inflight:  make(map[model.UserID]*refreshCall),
+	}
+}
+
+// AccessToken returns a token for the user that's valid for at least the skew window. The user's
+// token fields are updated if the token was refreshed.
+func (t *TokenManager) AccessToken(user *model.User) (string, error) {
+	if user.ReauthRequiredAt != nil {
+		t.Forget(user.ID)
+		return "", &RevokedError{UserID: user.ID, Cause: errors.Errorf("Re-authorization required")}
+	}
+
+	t.mu.Lock()
+	if token, ok := t.tokens[user.ID]; ok {
+		if t.fresh(token) {
+			t.mu.Unlock()
+			setUserToken(user, token)
+			return token.AccessToken, nil
+		}
+		delete(t.tokens, user.ID)
+	}
+
+	token := userToken(user)
+	if t.fresh(token) {
+		t.cache(user.ID, token)
+		t.mu.Unlock()
+		return token.AccessToken, nil
+	}
+
+	call, ok := t.inflight[user.ID]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		t.inflight[user.ID] = call
+		go t.refresh(user.ID, call)
+	}
+	t.mu.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		if IsRevoked(call.err) {
+			now := t.clock.Now()
+			user.ReauthRequiredAt = &now
+		}
+		return "", call.err
+	}
+
+	setUserToken(user, call.token)
+	return call.token.AccessToken, nil
+}
+
+// Store caches a newly issued token, e.g. after the user logs in.
+func (t *TokenManager) Store(userID model.UserID, token *oauth2.Token) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cache(userID, token)
+}
+
+// Forget drops the user's cached token, e.g. when their account is deleted or authorization revoked.
+func (t *TokenManager) Forget(userID model.UserID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.tokens, userID)
+}
+
+func (t *TokenManager) refresh(userID model.UserID, call *refreshCall) {
+	call.token, call.err = t.doRefresh(userID)
+
+	t.mu.Lock()
+	delete(t.inflight, userID)
+	if call.err == nil {
+		t.cache(userID, call.token)
+	} else {
+		delete(t.tokens, userID)
+	}
+	t.mu.Unlock()
+
+	close(call.done)
+}
+
+// cache stores a token and drops any cached tokens that are no longer fresh, at most once per skew
+// window, so tokens of users who stop making requests don't stay cached forever. t.mu must be held.
+func (t *TokenManager) cache(userID model.UserID, token *oauth2.Token) {
+	t.tokens[userID] = token
+
+	if now := t.clock.Now(); now.Sub(t.lastSweep) >= t.skew {
+		t.lastSweep = now
+		for id, cached := range t.tokens {
+			if !t.fresh(cached) {
+				delete(t.tokens, id)
+			}
+		}
+	}
+}
+
+func (t *TokenManager) doRefresh(userID model.UserID) (*oauth2.Token, error) {
+	// Reload in case the stored tokens changed since the caller loaded the user
+	user, err := t.userStore.GetUser(userID)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	} else if user == nil {
+		return nil, errors.Errorf("User `%s` not found", userID)
+	}
+
+	if token := userToken(user); t.fresh(token) {
+		return token, nil
+	}
+
+	token, err := retrieveToken(context.Background(), t.config, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {user.RefreshToken},
+	})
+	if revokedTokenError(err) {
+		glog.Infof("Spotify authorization revoked. userId=%s error=`%v`", userID, err)
+		if _, err := t.userStore.MarkReauthRequired(userID); err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+		return nil, &RevokedError{UserID: userID, Cause: err}
+	} else if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	glog.Infof("Saving new access token. userId=%s", userID)
+	setUserToken(user, token)
+	if _, err := t.userStore.UpsertUser(user); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return token, nil
+}
+
+func (t *TokenManager) fresh(token *oauth2.Token) bool {
+	return len(token.AccessToken) > 0 && t.clock.Now().Add(t.skew).Before(token.Expiry)
+}
+
+func userToken(user *model.User) *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  user.AccessToken,
+		RefreshToken: user.RefreshToken,
+		Expiry:       user.ExpiresAt,
+	}
+}
+
+func setUserToken(user *model.User, token *oauth2.Token) {
+	user.AccessToken = token.AccessToken
+	user.RefreshToken = token.RefreshToken
+	user.ExpiresAt = token.Expiry.In(time.UTC)
+}
@@ -11,6 +11,8 @@ import (
 
 type ContextPathVars struct{}
 type ContextUser struct{}
+type ContextSession struct{}
+type ContextCSRFToken struct{}
 
 func WithContext(handler http.HandlerFunc) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
@@ -36,6 +38,11 @@ func MustUserFromContext(ctx context.Context) *model.User {
 	return user
 }
 
+func CSRFTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(ContextCSRFToken{}).(string)
+	return token
+}
+
 func MustPathVarsFromContext(ctx context.Context) map[string]string {
 	vars := ctx.Value(ContextPathVars{})
 	if vars == nil {
@@ -0,0 +1,108 @@
+package requests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	CSRFHeader    = "X-CSRF-Token"
+	CSRFFormField = "csrf_token"
+)
+
+// CSRF guards state-changing requests with a synchronizer token kept in the session. Safe requests
+// get the token added to their context so templates can embed it.
+type CSRF struct {
+	sessions     *Sessions
+	errorHandler func(http.ResponseWriter, error)
+}
+
+func NewCSRF(sessions *Sessions, errorHandler func(http.ResponseWriter, error)) *CSRF {
+	return &CSRF{
+		sessions:     sessions,
+		errorHandler: errorHandler,
+	}
+}
+
+func (c *CSRF) Protect(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		session, err := c.sessions.GetSession(req)
+		if err != nil {
+			c.errorHandler(rw, err)
+			return
+		}
+
+		token, err := c.csrfToken(rw, req, session)
+		if err != nil {
+			c.errorHandler(rw, err)
+			return
+		}
+
+		if !safeMethod(req.Method) {
+			submitted := req.Header.Get(CSRFHeader)
+			if len(submitted) == 0 {
+				submitted = req.PostFormValue(CSRFFormField)
+			}
+
+			if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+				glog.Infof("Rejecting request with missing or invalid CSRF token. method=%s url=%v", req.Method, req.URL)
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), ContextSession{}, session)
+		ctx = context.WithValue(ctx, ContextCSRFToken{}, token)
+
+		handler(rw, req.WithContext(ctx))
+	}
+}
+
+// csrfToken returns the request's CSRF token, creating one if needed. Stored sessions keep the token, but
+// anonymous visitors get it in a signed cookie so that they don't each create a stored session.
+func (c *CSRF) csrfToken(rw http.ResponseWriter, req *http.Request, session *Session) (string, error) {
+	if token := session.CSRFToken(); len(token) > 0 {
+		return token, nil
+	}
+
+	// A session stored since, e.g. by logging in, keeps the token that its pages were rendered with
+	token := c.sessions.AnonymousCSRFToken(req)
+	if len(token) == 0 {
+		var err error
+		if token, err = newCSRFToken(); err != nil {
+			return "", err
+		}
+	} else if !session.Stored() {
+		return token, nil
+	}
+
+	if session.Stored() {
+		session.SetCSRFToken(token)
+		if err := session.Save(req, rw); err != nil {
+			return "", err
+		}
+	} else if err := c.sessions.SetAnonymousCSRFToken(rw, token); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func newCSRFToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
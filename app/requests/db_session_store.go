@@ -0,0 +1,212 @@
+package requests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/util"
+
+	"github.com/go-errors/errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	maxUserAgentLength = 255
+
+	// Avoid writing to the DB on every request just to bump the last seen time
+	lastSeenGranularity = time.Minute
+)
+
+// dbSessionStore keeps session values server-side. The cookie only holds a signed and encrypted
+// session ID, so sessions can be listed and revoked.
+type dbSessionStore struct {
+	store           model.SessionStore
+	codecs          []securecookie.Codec
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	clock           util.Clock
+}
+
+var _ sessions.Store = &dbSessionStore{}
+
+func newDBSessionStore(store model.SessionStore, idleTimeout, absoluteTimeout time.Duration, keyPairs ...[]byte) *dbSessionStore {
+	return &dbSessionStore{
+		store:           store,
+		codecs:          securecookie.CodecsFromPairs(keyPairs...),
+		idleTimeout:     idleTimeout,
+		absoluteTimeout: absoluteTimeout,
+		clock:           util.WallClock,
+	}
+}
+
+func (d *dbSessionStore) Get(req *http.Request, name string) (*sessions.Session, error) {
+	return d.New(req, name)
+}
+
+// New loads the session referenced by the request's cookie. If there is none, or it has expired or
+// been revoked, a new empty session is returned.
+func (d *dbSessionStore) New(req *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(d, name)
+	session.Options = d.options()
+	session.IsNew = true
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, d.codecs...); err != nil {
+		return session, errors.Wrap(err, 0)
+	}
+
+	record, err := d.store.GetSession(model.SessionID(id))
+	if err != nil {
+		return session, errors.Wrap(err, 0)
+	} else if record == nil || !d.clock.Now().Before(record.ExpiresAt) {
+		return session, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&session.Values); err != nil {
+		return session, errors.Wrap(err, 0)
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	if now := d.clock.Now(); now.Sub(record.LastSeenAt) >= lastSeenGranularity {
+		record.LastSeenAt = now
+		record.ExpiresAt = d.expiresAt(record.CreatedAt, now)
+		if err := d.store.UpdateSession(record); err != nil {
+			glog.Errorf("Unable to update session last seen time: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+func (d *dbSessionStore) Save(req *http.Request, rw http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if len(session.ID) > 0 {
+			if err := d.store.DeleteSession(model.SessionID(session.ID)); err != nil {
+				return errors.Wrap(err, 0)
+			}
+		}
+
+		http.SetCookie(rw, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	var userID *model.UserID
+	if value, ok := session.Values[sessionSpotifyUserID].(string); ok && len(value) > 0 {
+		id := model.UserID(value)
+		userID = &id
+	}
+
+	now := d.clock.Now()
+
+	var record *model.Session
+	if len(session.ID) > 0 {
+		var err error
+		if record, err = d.store.GetSession(model.SessionID(session.ID)); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	if record == nil {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+
+		userAgent := req.UserAgent()
+		if len(userAgent) > maxUserAgentLength {
+			userAgent = userAgent[:maxUserAgentLength]
+		}
+
+		session.ID = id
+		if err := d.store.CreateSession(&model.Session{
+			ID:         model.SessionID(id),
+			UserID:     userID,
+			Data:       data.Bytes(),
+			UserAgent:  userAgent,
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  d.expiresAt(now, now),
+		}); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	} else {
+		// A session that changes user gets a new ID, so a session ID can't be fixed before login
+		if !sameUser(record.UserID, userID) && userID != nil {
+			if err := d.store.DeleteSession(record.ID); err != nil {
+				return errors.Wrap(err, 0)
+			}
+			session.ID = ""
+			return d.Save(req, rw, session)
+		}
+
+		record.UserID = userID
+		record.Data = data.Bytes()
+		record.LastSeenAt = now
+		record.ExpiresAt = d.expiresAt(record.CreatedAt, now)
+		if err := d.store.UpdateSession(record); err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, d.codecs...)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	http.SetCookie(rw, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (d *dbSessionStore) options() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(d.absoluteTimeout / time.Second),
+		HttpOnly: true,
+	}
+}
+
+// expiresAt is when a session expires, whichever comes first of being idle too long or reaching its maximum age.
+func (d *dbSessionStore) expiresAt(createdAt, lastSeenAt time.Time) time.Time {
+	idleExpiry := lastSeenAt.Add(d.idleTimeout)
+	absoluteExpiry := createdAt.Add(d.absoluteTimeout)
+
+	if idleExpiry.Before(absoluteExpiry) {
+		return idleExpiry
+	}
+	return absoluteExpiry
+}
+
+func sameUser(a, b *model.UserID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func newSessionID() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
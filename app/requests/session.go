@@ -1,61 +1,162 @@
 package requests
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
 
 	"github.com/go-errors/errors"
 	"github.com/golang/glog"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
 const (
 	sessionName          = "spotifySession"
 	sessionSpotifyUserID = "spotifyUserID"
+	sessionCSRFToken     = "csrfToken"
+	sessionOAuthState    = "oauthState"
+	sessionOAuthRedirect = "oauthRedirect"
+	sessionOAuthVerifier = "oauthVerifier"
+
+	// Visitors without a stored session keep their CSRF token in this cookie instead
+	csrfCookieName = "csrfToken"
+
+	defaultIdleTimeout     = 14 * 24 * time.Hour
+	defaultAbsoluteTimeout = 90 * 24 * time.Hour
 )
 
 type SessionConfig struct {
+	// KeyPairs are ordered newest first. The first pair signs and encrypts new cookies, and all pairs
+	// are tried when decoding, so old keys can be retired without logging everyone out.
+	KeyPairs []*SessionKeyPair `yaml:"key_pairs"`
+
+	// Deprecated: single key pair used when KeyPairs is empty
+	Base64AuthenticationKey string `yaml:"authentication_key"`
+	Base64EncryptionKey     string `yaml:"encryption_key"`
+
+	// Sessions end after going unused for IdleTimeout, or AbsoluteTimeout after they were created
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout"`
+}
+
+type SessionKeyPair struct {
 	Base64AuthenticationKey string `yaml:"authentication_key"`
 	Base64EncryptionKey     string `yaml:"encryption_key"`
 }
 
-func (s *SessionConfig) AuthenticationKey() ([]byte, error) {
-	key, err := base64.StdEncoding.DecodeString(s.Base64AuthenticationKey)
+// DecodedKeys returns the decoded and validated keys, alternating authentication and encryption keys,
+// in the form expected by securecookie.CodecsFromPairs.
+func (s *SessionConfig) DecodedKeys() ([][]byte, error) {
+	pairs := s.KeyPairs
+	if len(pairs) == 0 && (len(s.Base64AuthenticationKey) > 0 || len(s.Base64EncryptionKey) > 0) {
+		pairs = []*SessionKeyPair{{
+			Base64AuthenticationKey: s.Base64AuthenticationKey,
+			Base64EncryptionKey:     s.Base64EncryptionKey,
+		}}
+	}
+	if len(pairs) == 0 {
+		return nil, errors.Errorf("No session keys configured")
+	}
+
+	var keys [][]byte
+	for i, pair := range pairs {
+		authKey, err := decodeSessionKey(pair.Base64AuthenticationKey, sessionAuthenticationKeyLengths)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("Invalid authentication key in session key pair %d", i), 0)
+		}
+
+		encryptionKey, err := decodeSessionKey(pair.Base64EncryptionKey, sessionEncryptionKeyLengths)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, fmt.Sprintf("Invalid encryption key in session key pair %d", i), 0)
+		}
+
+		keys = append(keys, authKey, encryptionKey)
+	}
+
+	return keys, nil
+}
+
+var (
+	// Lengths accepted for HMAC-SHA256 authentication keys. New keys are the first length.
+	sessionAuthenticationKeyLengths = []int{64, 32}
+
+	// Lengths accepted for AES-256, AES-192, and AES-128 encryption keys. New keys are the first length.
+	sessionEncryptionKeyLengths = []int{32, 24, 16}
+)
+
+func decodeSessionKey(base64Key string, lengths []int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(base64Key)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	return key, nil
+	for _, length := range lengths {
+		if len(key) == length {
+			return key, nil
+		}
+	}
+
+	return nil, errors.Errorf("Expected key length to be one of %v bytes but got %d bytes", lengths, len(key))
 }
 
-func (s *SessionConfig) EncryptionKey() ([]byte, error) {
-	key, err := base64.StdEncoding.DecodeString(s.Base64EncryptionKey)
-	if err != nil {
+// GenerateSessionKeyPair returns a new random key pair suitable for adding to SessionConfig.KeyPairs.
+func GenerateSessionKeyPair() (*SessionKeyPair, error) {
+	authKey := make([]byte, sessionAuthenticationKeyLengths[0])
+	if _, err := rand.Read(authKey); err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	return key, nil
+	encryptionKey := make([]byte, sessionEncryptionKeyLengths[0])
+	if _, err := rand.Read(encryptionKey); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return &SessionKeyPair{
+		Base64AuthenticationKey: base64.StdEncoding.EncodeToString(authKey),
+		Base64EncryptionKey:     base64.StdEncoding.EncodeToString(encryptionKey),
+	}, nil
 }
 
 type Sessions struct {
-	store sessions.Store
+	store   sessions.Store
+	codecs  []securecookie.Codec
+	options *sessions.Options
 }
 
-func NewSessions(config *SessionConfig) (*Sessions, error) {
-	authKey, err := config.AuthenticationKey()
+func NewSessions(config *SessionConfig, sessionStore model.SessionStore) (*Sessions, error) {
+	keyPairs, err := config.DecodedKeys()
 	if err != nil {
 		return nil, err
 	}
-	encryptionKey, err := config.EncryptionKey()
-	if err != nil {
-		return nil, err
+
+	idleTimeout := config.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	absoluteTimeout := config.AbsoluteTimeout
+	if absoluteTimeout == 0 {
+		absoluteTimeout = defaultAbsoluteTimeout
 	}
 
-	store := sessions.NewCookieStore(authKey, encryptionKey)
-	return &Sessions{store: store}, nil
+	store := newDBSessionStore(sessionStore, idleTimeout, absoluteTimeout, keyPairs...)
+	return &Sessions{
+		store:   store,
+		codecs:  store.codecs,
+		options: store.options(),
+	}, nil
 }
 
 func (s *Sessions) GetSession(req *http.Request) (*Session, error) {
+	// Share the session with anything earlier in the handler chain so changes aren't clobbered
+	if session, ok := req.Context().Value(ContextSession{}).(*Session); ok {
+		return session, nil
+	}
+
 	session, err := s.store.Get(req, sessionName)
 	if err != nil {
 		glog.Errorf("Could not decode session: %v", err)
@@ -64,6 +165,33 @@ func (s *Sessions) GetSession(req *http.Request) (*Session, error) {
 	return newSession(session), nil
 }
 
+// AnonymousCSRFToken returns the CSRF token from the request's signed cookie, or empty if there isn't a valid one.
+func (s *Sessions) AnonymousCSRFToken(req *http.Request) string {
+	cookie, err := req.Cookie(csrfCookieName)
+	if err != nil {
+		return ""
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(csrfCookieName, cookie.Value, &token, s.codecs...); err != nil {
+		glog.Infof("Could not decode CSRF cookie: %v", err)
+		return ""
+	}
+
+	return token
+}
+
+// SetAnonymousCSRFToken keeps a CSRF token in a signed cookie, for visitors without a stored session.
+func (s *Sessions) SetAnonymousCSRFToken(rw http.ResponseWriter, token string) error {
+	encoded, err := securecookie.EncodeMulti(csrfCookieName, token, s.codecs...)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	http.SetCookie(rw, sessions.NewCookie(csrfCookieName, encoded, s.options))
+	return nil
+}
+
 type Session struct {
 	underlying    *sessions.Session
 	spotifyUserID string
@@ -81,6 +209,15 @@ func newSession(underlying *sessions.Session) *Session {
 	return session
 }
 
+func (s *Session) ID() model.SessionID {
+	return model.SessionID(s.underlying.ID)
+}
+
+// Stored returns whether the session was loaded from the session store, rather than being new to this request.
+func (s *Session) Stored() bool {
+	return !s.underlying.IsNew
+}
+
 func (s *Session) SpotifyUserID() string {
 	if userID := s.underlying.Values[sessionSpotifyUserID]; userID != nil {
 		return userID.(string)
@@ -92,12 +229,50 @@ func (s *Session) SetSpotifyUserID(userID string) {
 	s.underlying.Values[sessionSpotifyUserID] = userID
 }
 
+func (s *Session) CSRFToken() string {
+	if token := s.underlying.Values[sessionCSRFToken]; token != nil {
+		return token.(string)
+	}
+	return ""
+}
+
+func (s *Session) SetCSRFToken(token string) {
+	s.underlying.Values[sessionCSRFToken] = token
+}
+
+// SetOAuthState stores the nonce sent as the OAuth state parameter, the PKCE code verifier,
+// and where to send the user once they have logged in.
+func (s *Session) SetOAuthState(state, codeVerifier, redirect string) {
+	s.underlying.Values[sessionOAuthState] = state
+	s.underlying.Values[sessionOAuthVerifier] = codeVerifier
+	s.underlying.Values[sessionOAuthRedirect] = redirect
+}
+
+// TakeOAuthState returns and clears the values set by SetOAuthState, so that each state is only usable once.
+func (s *Session) TakeOAuthState() (state, codeVerifier, redirect string) {
+	state, _ = s.underlying.Values[sessionOAuthState].(string)
+	codeVerifier, _ = s.underlying.Values[sessionOAuthVerifier].(string)
+	redirect, _ = s.underlying.Values[sessionOAuthRedirect].(string)
+
+	delete(s.underlying.Values, sessionOAuthState)
+	delete(s.underlying.Values, sessionOAuthVerifier)
+	delete(s.underlying.Values, sessionOAuthRedirect)
+
+	return state, codeVerifier, redirect
+}
+
 func (s *Session) Delete(req *http.Request, rw http.ResponseWriter) {
 	delete(s.underlying.Values, sessionSpotifyUserID)
 	s.underlying.Options.MaxAge = -1
-	s.underlying.Save(req, rw)
+	if err := s.underlying.Save(req, rw); err != nil {
+		glog.Errorf("Unable to delete session: %v", err)
+	}
 }
 
-func (s *Session) Save(req *http.Request, rw http.ResponseWriter) {
-	s.underlying.Save(req, rw)
+func (s *Session) Save(req *http.Request, rw http.ResponseWriter) error {
+	if err := s.underlying.Save(req, rw); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
 }
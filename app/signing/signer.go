@@ -0,0 +1,114 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+type Purpose string
+
+const (
+	PurposeUnsubscribe Purpose = "unsubscribe"
+)
+
+var (
+	ErrInvalidToken = errors.Errorf("Invalid signed token")
+	ErrExpiredToken = errors.Errorf("Expired signed token")
+)
+
+type Config struct {
+	Base64Key string `yaml:"key"`
+}
+
+// GenerateConfig returns a config with a new random key.
+func GenerateConfig() (*Config, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	return &Config{Base64Key: base64.StdEncoding.EncodeToString(key)}, nil
+}
+
+func (c *Config) Key() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.Base64Key)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	} else if len(key) < 32 {
+		return nil, errors.Errorf("Signing key must be at least 32 bytes, not %d", len(key))
+	}
+
+	return key, nil
+}
+
+// Signer creates and verifies tamper-proof tokens. Each token is scoped to a purpose, so a token
+// minted for one use can't be replayed for another, and carries its own expiry.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(config *Config) (*Signer, error) {
+	if config == nil {
+		return nil, errors.Errorf("Missing signing config")
+	}
+
+	key, err := config.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{key: key}, nil
+}
+
+func (s *Signer) Sign(purpose Purpose, payload string, expiresAt time.Time) string {
+	body := fmt.Sprintf("%d:%s", expiresAt.Unix(), payload)
+	encodedBody := base64.RawURLEncoding.EncodeToString([]byte(body))
+
+	return fmt.Sprintf("%s.%s", encodedBody, base64.RawURLEncoding.EncodeToString(s.mac(purpose, encodedBody)))
+}
+
+// Verify returns the payload of a token signed for the given purpose, as long as it hasn't expired.
+func (s *Signer) Verify(purpose Purpose, token string, now time.Time) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, s.mac(purpose, parts[0])) {
+		return "", ErrInvalidToken
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	bodyParts := strings.SplitN(string(body), ":", 2)
+	if len(bodyParts) != 2 {
+		return "", ErrInvalidToken
+	}
+
+	expiresAtUnix, err := strconv.ParseInt(bodyParts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	} else if !now.Before(time.Unix(expiresAtUnix, 0)) {
+		return "", ErrExpiredToken
+	}
+
+	return bodyParts[1], nil
+}
+
+func (s *Signer) mac(purpose Purpose, encodedBody string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(h, "%s.%s", purpose, encodedBody)
+	return h.Sum(nil)
+}
@@ -0,0 +1,36 @@
+package templates
+
+import (
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+)
+
+var AccountView = extend(PageLayout, "account_view")
+
+type Session struct {
+	ID         model.SessionID
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+func NewSession(session *model.Session, currentID model.SessionID) *Session {
+	return &Session{
+		ID:         session.ID,
+		UserAgent:  session.UserAgent,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		Current:    session.ID == currentID,
+	}
+}
+
+type AccountViewData struct {
+	LayoutData
+	Name            string
+	Email           string
+	AutoSubscribe   bool
+	AutoUnsubscribe bool
+	Sessions        []*Session
+}
@@ -0,0 +1,8 @@
+package templates
+
+type AuthDeniedViewData struct {
+	LayoutData
+	RetryURL string
+}
+
+var AuthDeniedView = extend(PageLayout, "auth_denied_view")
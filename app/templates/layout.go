@@ -1,7 +1,8 @@
 package templates
 
 type LayoutData struct {
-	SignedIn bool
+	SignedIn  bool
+	CSRFToken string
 }
 
 var PageLayout = parse("layout")
@@ -0,0 +1,23 @@
+package templates
+
+import (
+	"github.com/alecholmes/spotlight/app/model"
+)
+
+var NotificationFilterView = extend(PageLayout, "notification_filter_view")
+
+type FilterCollaborator struct {
+	UserID   model.UserID
+	Name     string
+	Selected bool
+}
+
+type NotificationFilterViewData struct {
+	LayoutData
+	Token         model.SubscriptionToken
+	PlaylistName  string
+	IncludeOwn    bool
+	Collaborators []*FilterCollaborator
+	ArtistNames   string // Comma separated
+	MinTrackCount int
+}
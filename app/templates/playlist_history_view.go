@@ -0,0 +1,79 @@
+package templates
+
+import (
+	"strings"
+	"time"
+
+	"github.com/alecholmes/spotlight/app/model"
+)
+
+var PlaylistHistoryView = extend(PageLayout, "playlist_history_view")
+
+type HistorySnapshot struct {
+	SnapshotID    string
+	Name          string
+	Collaborative bool
+	CreatedAt     time.Time
+	Selected      bool
+	Compared      bool
+}
+
+func NewHistorySnapshot(playlist *model.Playlist) *HistorySnapshot {
+	return &HistorySnapshot{
+		SnapshotID:    playlist.SnapshotID,
+		Name:          playlist.Name,
+		Collaborative: playlist.Collaborative,
+		CreatedAt:     playlist.CreatedAt,
+	}
+}
+
+type HistoryTrack struct {
+	Position    int
+	Name        string
+	ArtistNames string
+	AlbumName   string
+	URL         string
+	AddedBy     model.UserID
+	AddedAt     *time.Time
+}
+
+func NewHistoryTrack(track *model.PlaylistTrack) *HistoryTrack {
+	templated := &HistoryTrack{
+		Position: track.Position + 1,
+		Name:     track.TrackID,
+		AddedBy:  track.AddedBy,
+		AddedAt:  track.AddedAt,
+	}
+
+	if metadata := track.Metadata; metadata != nil {
+		templated.Name = metadata.Name
+		templated.ArtistNames = strings.Join(metadata.ArtistNames, ", ")
+		templated.AlbumName = metadata.AlbumName
+		templated.URL = metadata.URL
+	}
+
+	return templated
+}
+
+func NewHistoryTracks(tracks []*model.PlaylistTrack) []*HistoryTrack {
+	templated := make([]*HistoryTrack, len(tracks))
+	for i, track := range tracks {
+		templated[i] = NewHistoryTrack(track)
+	}
+
+	return templated
+}
+
+// PlaylistHistoryViewData shows a playlist as it was at the selected snapshot. When another snapshot is
+// being compared, Added and Removed are the changes from the selected one to it.
+type PlaylistHistoryViewData struct {
+	LayoutData
+	PlaylistID  model.PlaylistID
+	CurrentName string
+	Snapshots   []*HistorySnapshot
+	Selected    *HistorySnapshot
+	Tracks      []*HistoryTrack
+	Compared    *HistorySnapshot
+	Added       []*HistoryTrack
+	Removed     []*HistoryTrack
+}
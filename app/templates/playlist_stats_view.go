@@ -0,0 +1,190 @@
+package templates
+
+import (
+	"math"
+
+	"github.com/alecholmes/spotlight/app/model"
+)
+
+var PlaylistStatsView = extend(PageLayout, "playlist_stats_view")
+
+const (
+	chartWidth = 600
+
+	// Bar charts have a row per item, labeled on the left and with its value on the right
+	barChartRowHeight  = 24
+	barChartLabelWidth = 180
+	barChartValueWidth = 80
+
+	// Column charts have a column per item, with some of them labeled underneath
+	columnChartPlotHeight = 160
+	columnChartAxisHeight = 20
+	columnChartMaxLabels  = 6
+
+	// Longer bar labels are shortened to fit, with the full label shown on hover
+	barChartLabelLength = 24
+)
+
+type ChartItem struct {
+	Label string
+	Value int
+}
+
+type ChartBar struct {
+	Label      string
+	ShortLabel string
+	Value      int
+	Percent    int
+	X          float64
+	Y          float64
+	Width      float64
+	Height     float64
+	LabelX     float64
+	ValueX     float64
+	TextY      float64
+}
+
+type ChartLabel struct {
+	Text string
+	X    float64
+	Y    float64
+}
+
+// Chart is laid out for drawing as SVG, with coordinates in a Width by Height view box.
+type Chart struct {
+	Width  int
+	Height int
+	Bars   []*ChartBar
+	Labels []*ChartLabel
+}
+
+// NewBarChart lays out a horizontal bar per item, with percentages of total.
+func NewBarChart(items []*ChartItem, total int) *Chart {
+	chart := &Chart{
+		Width:  chartWidth,
+		Height: len(items) * barChartRowHeight,
+	}
+
+	plotWidth := float64(chartWidth - barChartLabelWidth - barChartValueWidth)
+	max := maxChartValue(items)
+	for i, item := range items {
+		y := float64(i * barChartRowHeight)
+		width := plotWidth * float64(item.Value) / float64(max)
+
+		bar := &ChartBar{
+			Label:      item.Label,
+			ShortLabel: shortenLabel(item.Label),
+			Value:      item.Value,
+			X:          barChartLabelWidth,
+			Y:          y + 4,
+			Width:      width,
+			Height:     barChartRowHeight - 8,
+			LabelX:     barChartLabelWidth - 8,
+			ValueX:     barChartLabelWidth + width + 6,
+			TextY:      y + barChartRowHeight/2 + 4,
+		}
+		if total > 0 {
+			bar.Percent = int(math.Round(100 * float64(item.Value) / float64(total)))
+		}
+
+		chart.Bars = append(chart.Bars, bar)
+	}
+
+	return chart
+}
+
+// NewColumnChart lays out a column per item, in order, labeling evenly spaced columns.
+func NewColumnChart(items []*ChartItem) *Chart {
+	chart := &Chart{
+		Width:  chartWidth,
+		Height: columnChartPlotHeight + columnChartAxisHeight,
+	}
+	if len(items) == 0 {
+		return chart
+	}
+
+	slotWidth := float64(chartWidth) / float64(len(items))
+	labelEvery := int(math.Ceil(float64(len(items)) / columnChartMaxLabels))
+	max := maxChartValue(items)
+	for i, item := range items {
+		height := columnChartPlotHeight * float64(item.Value) / float64(max)
+		x := float64(i) * slotWidth
+
+		chart.Bars = append(chart.Bars, &ChartBar{
+			Label:  item.Label,
+			Value:  item.Value,
+			X:      x + slotWidth*0.1,
+			Y:      columnChartPlotHeight - height,
+			Width:  slotWidth * 0.8,
+			Height: height,
+		})
+
+		if i%labelEvery == 0 {
+			chart.Labels = append(chart.Labels, &ChartLabel{
+				Text: item.Label,
+				X:    x + slotWidth/2,
+				Y:    columnChartPlotHeight + columnChartAxisHeight - 4,
+			})
+		}
+	}
+
+	return chart
+}
+
+func shortenLabel(label string) string {
+	runes := []rune(label)
+	if len(runes) <= barChartLabelLength {
+		return label
+	}
+
+	return string(runes[:barChartLabelLength-1]) + "…"
+}
+
+func maxChartValue(items []*ChartItem) int {
+	max := 1
+	for _, item := range items {
+		if item.Value > max {
+			max = item.Value
+		}
+	}
+
+	return max
+}
+
+// NewChartItems makes an item per count. Counts with empty names are labeled as unknown.
+func NewChartItems(counts []*model.StatCount, names map[string]string) []*ChartItem {
+	items := make([]*ChartItem, len(counts))
+	for i, count := range counts {
+		label := count.Name
+		if name, ok := names[count.Name]; ok {
+			label = name
+		} else if len(label) == 0 {
+			label = "Unknown"
+		}
+
+		items[i] = &ChartItem{Label: label, Value: count.Count}
+	}
+
+	return items
+}
+
+func NewWeeklyChartItems(weeklyCounts []*model.WeeklyCount) []*ChartItem {
+	items := make([]*ChartItem, len(weeklyCounts))
+	for i, weeklyCount := range weeklyCounts {
+		items[i] = &ChartItem{Label: weeklyCount.WeekOf.Format("Jan 2"), Value: weeklyCount.Count}
+	}
+
+	return items
+}
+
+type PlaylistStatsViewData struct {
+	LayoutData
+	PlaylistID       model.PlaylistID
+	PlaylistName     string
+	TrackCount       int
+	ContributorCount int
+	Contributors     *Chart
+	TopArtists       *Chart
+	TopAlbums        *Chart
+	WeeklyTracks     *Chart
+}
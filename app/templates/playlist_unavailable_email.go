@@ -0,0 +1,11 @@
+package templates
+
+type PlaylistUnavailableEmailData struct {
+	Name             string
+	PlaylistName     string
+	Deleted          bool
+	SubscriptionsURL string
+	AppBaseURL       string
+}
+
+var PlaylistUnavailableEmailHTML = parse("playlist_unavailable_email")
@@ -0,0 +1,9 @@
+package templates
+
+type ReauthEmailData struct {
+	Name       string
+	SignInURL  string
+	AppBaseURL string
+}
+
+var ReauthEmailHTML = parse("reauth_email")
@@ -20,27 +20,25 @@ type ShareEmailData struct {
 	AppBaseURL   string
 }
 
-func NewShareEmailData(inviter *spotify.PrivateProfile, playlist *spotify.Playlist, appBaseURL string) *ShareEmailData {
+func NewShareEmailData(inviter *model.User, invitation *model.Invitation, playlist *spotify.Playlist,
+	appBaseURL string) *ShareEmailData {
+
 	query := make(url.Values)
-	query.Set("inviterName", inviter.DisplayName)
-	query.Set("inviterEmail", inviter.Email)
-	query.Set("ownerId", playlist.Owner.ID)
-	query.Set("playlistId", playlist.ID)
-	query.Set("playlistName", playlist.Name)
+	query.Set("token", string(invitation.Token))
 
 	subscribeURL := fmt.Sprintf("%s/subscriptions/share?%s", appBaseURL, query.Encode())
 
 	return &ShareEmailData{
 		Inviter:      NewFullUser(inviter),
-		Playlist:     NewPlaylist(playlist, model.SubscriptionToken("")),
+		Playlist:     NewPlaylist(playlist, nil),
 		SubscribeURL: subscribeURL,
 		AppBaseURL:   appBaseURL,
 	}
 }
 
-func NewFullUser(user *spotify.PrivateProfile) *FullUser {
+func NewFullUser(user *model.User) *FullUser {
 	return &FullUser{
-		Name:  user.DisplayName,
+		Name:  user.Name,
 		Email: user.Email,
 	}
 }
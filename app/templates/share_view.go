@@ -3,10 +3,11 @@ package templates
 // TODO: include playlist URL
 type ShareViewData struct {
 	LayoutData
-	InviterName  string
-	InviterEmail string
-	PlaylistName string
-	SubscribeURL string
+	InviterName     string
+	InviterEmail    string
+	PlaylistName    string
+	InvitationToken string
+	SignInURL       string
 }
 
 var ShareView = extend(PageLayout, "share_view")
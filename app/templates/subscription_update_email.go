@@ -10,6 +10,18 @@ type UpdateSubscriptionEmailData struct {
 	Activities        []*Activity
 	ActorsDescription string
 	AppBaseURL        string
+	UnsubscribeURL    string
+}
+
+// OnlyFollowers is true if the update is just other users following the playlist.
+func (u *UpdateSubscriptionEmailData) OnlyFollowers() bool {
+	for _, activity := range u.Activities {
+		if !activity.PlaylistFollowed {
+			return false
+		}
+	}
+
+	return len(u.Activities) > 0
 }
 
 func PrettyActorNames(activities []*Activity, max int) string {
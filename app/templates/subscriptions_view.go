@@ -2,6 +2,7 @@ package templates
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/alecholmes/spotlight/app/model"
 	"github.com/alecholmes/spotlight/spotify"
@@ -10,13 +11,19 @@ import (
 var SubscriptionsView = extend(PageLayout, "subscriptions_view")
 
 type Activity struct {
-	ActorName    string
-	Description  string
-	PlaylistName string
-	PlaylistURL  string
-	EmbedURL     string
-	TrackName    string
-	TrackURL     string
+	ActorName   string
+	Description string
+
+	// PlaylistActivity is set for activities about the playlist itself rather than a track. Detail
+	// follows the playlist name when describing them.
+	PlaylistActivity bool
+	PlaylistFollowed bool
+	Detail           string
+	PlaylistName     string
+	PlaylistURL      string
+	EmbedURL         string
+	TrackName        string
+	TrackURL         string
 }
 
 type Playlist struct {
@@ -25,39 +32,132 @@ type Playlist struct {
 	OwnerID           string
 	ExternalURL       string
 	SubscriptionToken model.SubscriptionToken
+	Owned             bool
+	Paused            bool
+	SnoozedUntil      *time.Time
+}
+
+// NewPlaylist templates a playlist, with the user's subscription to it if they have one. The playlist is nil
+// if it can no longer be fetched, e.g. it was deleted, in which case the subscription's stored details are
+// used without a link.
+func NewPlaylist(playlist *spotify.Playlist, sub *model.Subscription) *Playlist {
+	templated := new(Playlist)
+	if sub != nil {
+		templated.ID = string(sub.PlaylistID)
+		templated.Name = sub.PlaylistName
+		templated.OwnerID = string(sub.PlaylistOwnerID)
+		templated.SubscriptionToken = sub.Token
+	}
+	if playlist != nil {
+		templated.ID = playlist.ID
+		templated.Name = playlist.Name
+		templated.OwnerID = playlist.Owner.ID
+		templated.ExternalURL = playlist.ExternalURLs["spotify"] // TODO fix
+	}
+
+	return templated
 }
 
-func NewPlaylist(playlist *spotify.Playlist, subToken model.SubscriptionToken) *Playlist {
-	return &Playlist{
-		ID:                playlist.ID,
-		Name:              playlist.Name,
-		OwnerID:           playlist.Owner.ID,
-		ExternalURL:       playlist.ExternalURLs["spotify"], // TODO fix
-		SubscriptionToken: subToken,
+// NewActivity templates an activity. The actor is nil if who did it isn't known, and the playlist is nil if it
+// can no longer be fetched, in which case the subscription's stored playlist name is used without a link.
+func NewActivity(activity *model.Activity, actor *spotify.PublicProfile, playlist *spotify.Playlist, sub *model.Subscription) *Activity {
+	templated := &Activity{
+		ActorName: "Someone",
+	}
+	if playlist != nil {
+		templated.PlaylistName = playlist.Name
+		templated.PlaylistURL = playlist.ExternalURLs["spotify"] // TODO fix
+	} else if sub != nil {
+		templated.PlaylistName = sub.PlaylistName
+	}
+	if actor != nil {
+		templated.ActorName = actor.DisplayName
+	}
+
+	data := activity.Data
+	templated.PlaylistActivity = true
+	switch {
+	case data.PlaylistFollowed != nil:
+		templated.Description = "started following"
+		templated.PlaylistFollowed = true
+	case data.PlaylistRenamed != nil:
+		templated.Description = "renamed"
+		templated.Detail = fmt.Sprintf(" (previously “%s”)", data.PlaylistRenamed.OldName)
+	case data.PlaylistDescriptionChanged != nil:
+		templated.Description = "changed the description of"
+	case data.PlaylistMadeNonCollaborative != nil:
+		templated.Description = "made"
+		templated.Detail = " no longer collaborative"
+	case data.PlaylistReordered != nil:
+		templated.Description = "reordered tracks in"
+	case data.TrackAdded != nil && data.TrackMetadata != nil && data.TrackMetadata.Episode:
+		templated.Description = "added the episode"
+		templated.PlaylistActivity = false
+	case data.TrackAdded != nil && data.TrackMetadata != nil && data.TrackMetadata.Local:
+		templated.Description = "added the local file"
+		templated.PlaylistActivity = false
+	case data.TrackAdded != nil:
+		templated.Description = "added"
+		templated.PlaylistActivity = false
+	default:
+		templated.Description = "did something mysterious to"
+		templated.PlaylistActivity = false
 	}
+
+	if track := data.TrackMetadata; track != nil {
+		// Local files are only on the adder's device, so can't be played here
+		if !track.Local {
+			templated.EmbedURL = fmt.Sprintf("https://embed.spotify.com/?uri=%s&theme=white", track.URI)
+		}
+		templated.TrackName = track.Name
+		templated.TrackURL = track.URL
+	}
+
+	return templated
+}
+
+// UnfollowedSubscription is a subscription to a playlist the user has unfollowed in Spotify.
+type UnfollowedSubscription struct {
+	Token        model.SubscriptionToken
+	PlaylistName string
+	UnfollowedAt time.Time
+}
+
+func NewUnfollowedSubscription(sub *model.Subscription) *UnfollowedSubscription {
+	return &UnfollowedSubscription{
+		Token:        sub.Token,
+		PlaylistName: sub.PlaylistName,
+		UnfollowedAt: *sub.UnfollowedAt,
+	}
+}
+
+// UnavailableSubscription is a subscription that stopped because its playlist was deleted or the user
+// lost access to it.
+type UnavailableSubscription struct {
+	Token        model.SubscriptionToken
+	PlaylistName string
+	Reason       string
+	Since        *time.Time
 }
 
-func NewActivity(activity *model.Activity, actor *spotify.PublicProfile, playlist *spotify.Playlist) *Activity {
-	var description string
-	if activity.Data.TrackAdded != nil {
-		description = "added"
-	} else {
-		description = "did something mysterious to"
+func NewUnavailableSubscription(sub *model.Subscription) *UnavailableSubscription {
+	reason := "You no longer have access to this playlist"
+	if sub.Status == model.SubscriptionPlaylistDeleted {
+		reason = "This playlist was deleted"
 	}
 
-	return &Activity{
-		ActorName:    actor.DisplayName,
-		Description:  description,
-		PlaylistName: playlist.Name,
-		PlaylistURL:  playlist.ExternalURLs["spotify"], // TODO fix
-		EmbedURL:     fmt.Sprintf("https://embed.spotify.com/?uri=%s&theme=white", activity.Data.TrackMetadata.URI),
-		TrackName:    activity.Data.TrackMetadata.Name,
-		TrackURL:     activity.Data.TrackMetadata.URL,
+	return &UnavailableSubscription{
+		Token:        sub.Token,
+		PlaylistName: sub.PlaylistName,
+		Reason:       reason,
+		Since:        sub.StatusChangedAt,
 	}
 }
 
 type SubscriptionsViewData struct {
 	LayoutData
-	Activities []*Activity
-	Playlists  []*Playlist
+	Activities  []*Activity
+	Playlists   []*Playlist
+	Unfollowed  []*UnfollowedSubscription
+	Unavailable []*UnavailableSubscription
 }
@@ -0,0 +1,10 @@
+package templates
+
+type UnsubscribeViewData struct {
+	LayoutData
+	PlaylistName   string
+	UnsubscribeURL string
+	Unsubscribed   bool
+}
+
+var UnsubscribeView = extend(PageLayout, "unsubscribe_view")
@@ -8,8 +8,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/alecholmes/spotlight/app"
+	"github.com/alecholmes/spotlight/app/model"
+	"github.com/alecholmes/spotlight/app/requests"
+	"github.com/alecholmes/spotlight/app/signing"
 
 	"github.com/go-errors/errors"
 	"github.com/golang/glog"
@@ -19,6 +23,24 @@ func main() {
 	flag.Parse() // Due to glog being needy
 	defer glog.Flush()
 
+	switch flag.Arg(0) {
+	case "generate-session-keys":
+		if err := generateSessionKeys(); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	case "generate-encryption-key":
+		if err := generateEncryptionKey(); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	case "generate-signing-key":
+		if err := generateSigningKey(); err != nil {
+			glog.Fatal(err)
+		}
+		return
+	}
+
 	config, err := loadConfig()
 	if err != nil {
 		glog.Fatal(err)
@@ -47,6 +69,45 @@ func main() {
 	wg.Wait()
 }
 
+// generateSessionKeys prints a new session key pair. Add it to the start of http_session.key_pairs,
+// and remove the oldest pair once sessions encoded with it are no longer needed.
+func generateSessionKeys() error {
+	keyPair, err := requests.GenerateSessionKeyPair()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("- authentication_key: %s\n  encryption_key: %s\n",
+		keyPair.Base64AuthenticationKey, keyPair.Base64EncryptionKey)
+
+	return nil
+}
+
+// generateEncryptionKey prints a new token encryption key, named after today's date. Add it to
+// token_encryption.keys and make it the primary_key_id to rotate keys.
+func generateEncryptionKey() error {
+	keyConfig, err := model.GenerateEncryptionKeyConfig(time.Now().UTC().Format("20060102"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("- id: \"%s\"\n  key: %s\n", keyConfig.ID, keyConfig.Base64Key)
+
+	return nil
+}
+
+// generateSigningKey prints a new signing key for the signing section.
+func generateSigningKey() error {
+	config, err := signing.GenerateConfig()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("key: %s\n", config.Base64Key)
+
+	return nil
+}
+
 func loadConfig() (*app.AppConfig, error) {
 	env := os.Getenv("ENVIRONMENT")
 	if len(env) == 0 {
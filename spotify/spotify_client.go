@@ -2,11 +2,13 @@ package spotify
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -21,6 +23,12 @@ const (
 	PlaylistCollaborative
 
 	spotifyAPIURL = "https://api.spotify.com"
+
+	// Spotify accepts at most this many tracks per request when changing a playlist
+	playlistTracksBatchSize = 100
+
+	// Cover images are limited to 256 KB once base64 encoded
+	maxCoverImageSize = 256 * 1024
 )
 
 type PrivateProfile struct {
@@ -42,22 +50,45 @@ type Album struct {
 	ExternalURLs map[string]string `json:"external_urls"`
 }
 
+type Show struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	ExternalURLs map[string]string `json:"external_urls"`
+}
+
+const (
+	TrackTypeTrack   = "track"
+	TrackTypeEpisode = "episode"
+)
+
+// Track is either a song or, when Type is TrackTypeEpisode, a podcast episode. Local files have no ID,
+// and may be missing their artists and album.
 type Track struct {
 	ID           string            `json:"id"`
+	Type         string            `json:"type"`
 	Name         string            `json:"name"`
 	Arists       []*Artist         `json:"artists"`
 	Album        *Album            `json:"album"`
+	Show         *Show             `json:"show"`
+	IsLocal      bool              `json:"is_local"`
 	ExternalURLs map[string]string `json:"external_urls"`
 	URI          string            `json:"uri"`
 }
 
+func (t *Track) IsEpisode() bool {
+	return t.Type == TrackTypeEpisode
+}
+
 type PublicProfile struct {
 	ID          string `json:"id"`
 	DisplayName string `json:"display_name"`
 }
 
+// PlaylistTrack is an entry in a playlist. The same track can appear more than once, Track is nil
+// if it's no longer available, and AddedBy is nil for very old playlists.
 type PlaylistTrack struct {
 	Track   *Track         `json:"track"`
+	IsLocal bool           `json:"is_local"`
 	AddedAt time.Time      `json:"added_at"`
 	AddedBy *PublicProfile `json:"added_by"`
 }
@@ -70,6 +101,7 @@ type listPlaylistTracks struct {
 type Playlist struct {
 	ID             string            `json:"id"`
 	Name           string            `json:"name"`
+	Description    string            `json:"description"`
 	Owner          *PublicProfile    `json:"owner"`
 	SnapshotID     string            `json:"snapshot_id"`
 	Collaborative  bool              `json:"collaborative"`
@@ -78,6 +110,25 @@ type Playlist struct {
 	RawTracks      listPlaylistTracks `json:"tracks"`
 }
 
+// TrackPositions identifies entries to remove from a playlist. If Positions is empty, every entry of the
+// track is removed.
+type TrackPositions struct {
+	URI       string `json:"uri"`
+	Positions []int  `json:"positions,omitempty"`
+}
+
+// PlaylistDetails are the details to change on a playlist. Nil fields are left unchanged.
+type PlaylistDetails struct {
+	Name          *string `json:"name,omitempty"`
+	Description   *string `json:"description,omitempty"`
+	Public        *bool   `json:"public,omitempty"`
+	Collaborative *bool   `json:"collaborative,omitempty"`
+}
+
+type snapshotResponse struct {
+	SnapshotID string `json:"snapshot_id"`
+}
+
 type listPlaylists struct {
 	Playlists []*Playlist `json:"items"`
 	Next      string      `json:"next,omitempty"`
@@ -142,12 +193,31 @@ func (s *SpotifyClient) ListMyPlaylists() ([]*Playlist, error) {
 	return allPlaylists, nil
 }
 
+// CanAccessPlaylist returns whether the playlist exists and the user can access it, without fetching its tracks.
+func (s *SpotifyClient) CanAccessPlaylist(userID, playlistID string) (bool, error) {
+	playlist := new(Playlist)
+	queryParams := map[string]string{
+		"fields": "snapshot_id",
+	}
+	resp, err := s.get(fmt.Sprintf("/v1/users/%s/playlists/%s", userID, playlistID), queryParams, true, playlist)
+	if err != nil {
+		return false, errors.Wrap(err, 0)
+	}
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// GetPlaylist returns nil if the playlist doesn't exist or the user can't access it.
 func (s *SpotifyClient) GetPlaylist(userID, playlistID string) (*Playlist, error) {
 	playlist := new(Playlist)
-	resp, err := s.get(fmt.Sprintf("/v1/users/%s/playlists/%s", userID, playlistID), nil, true, &playlist)
+	// Without additional_types, episodes are returned as null tracks
+	queryParams := map[string]string{
+		"additional_types": "track,episode",
+	}
+	resp, err := s.get(fmt.Sprintf("/v1/users/%s/playlists/%s", userID, playlistID), queryParams, true, &playlist)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
-	} else if resp.StatusCode == http.StatusNotFound {
+	} else if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
 		return nil, nil
 	}
 
@@ -188,7 +258,7 @@ func (s *SpotifyClient) FollowPlaylist(ownerID, playlistID string, public bool)
 	queryParams := map[string]string{
 		"public": fmt.Sprintf("%t", public),
 	}
-	resp, err := s.put(path, queryParams, nil)
+	resp, err := s.put(path, queryParams, nil, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
@@ -196,8 +266,136 @@ func (s *SpotifyClient) FollowPlaylist(ownerID, playlistID string, public bool)
 	return resp, nil
 }
 
+func (s *SpotifyClient) UnfollowPlaylist(ownerID, playlistID string) error {
+	path := fmt.Sprintf("/v1/users/%s/playlists/%s/followers", ownerID, playlistID)
+	if _, err := s.delete(path, nil, nil); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// AddTracks appends tracks to a playlist, given their URIs, and returns the playlist's new snapshot ID.
+// Tracks are added in batches, so a failure can leave only some of them added.
+func (s *SpotifyClient) AddTracks(playlistID string, uris []string) (string, error) {
+	var snapshotID string
+	for start := 0; start < len(uris); start += playlistTracksBatchSize {
+		resp := new(snapshotResponse)
+		req := map[string]interface{}{
+			"uris": uris[start:batchEnd(start, len(uris))],
+		}
+		if _, err := s.post(fmt.Sprintf("/v1/playlists/%s/tracks", playlistID), req, resp); err != nil {
+			return "", errors.Wrap(err, 0)
+		}
+		snapshotID = resp.SnapshotID
+	}
+
+	return snapshotID, nil
+}
+
+// RemoveTracks removes tracks from a playlist and returns its new snapshot ID. Tracks with positions only
+// have the entries at those positions in snapshotID removed, otherwise every entry of the track is removed.
+// Every batch is applied against snapshotID, so positions don't shift between batches.
+func (s *SpotifyClient) RemoveTracks(playlistID, snapshotID string, tracks []*TrackPositions) (string, error) {
+	newSnapshotID := snapshotID
+	for start := 0; start < len(tracks); start += playlistTracksBatchSize {
+		resp := new(snapshotResponse)
+		req := map[string]interface{}{
+			"tracks": tracks[start:batchEnd(start, len(tracks))],
+		}
+		if len(snapshotID) > 0 {
+			req["snapshot_id"] = snapshotID
+		}
+		if _, err := s.delete(fmt.Sprintf("/v1/playlists/%s/tracks", playlistID), req, resp); err != nil {
+			return "", errors.Wrap(err, 0)
+		}
+		newSnapshotID = resp.SnapshotID
+	}
+
+	return newSnapshotID, nil
+}
+
+// ReorderTracks moves rangeLength entries starting at rangeStart to before the entry at insertBefore, and
+// returns the playlist's new snapshot ID. Positions are in snapshotID, or the latest snapshot if it's empty.
+func (s *SpotifyClient) ReorderTracks(playlistID, snapshotID string, rangeStart, rangeLength, insertBefore int) (string, error) {
+	resp := new(snapshotResponse)
+	req := map[string]interface{}{
+		"range_start":   rangeStart,
+		"range_length":  rangeLength,
+		"insert_before": insertBefore,
+	}
+	if len(snapshotID) > 0 {
+		req["snapshot_id"] = snapshotID
+	}
+	if _, err := s.put(fmt.Sprintf("/v1/playlists/%s/tracks", playlistID), nil, req, resp); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	return resp.SnapshotID, nil
+}
+
+// ReplaceTracks replaces all of a playlist's tracks, given their URIs, and returns its new snapshot ID.
+// Spotify only replaces a batch of tracks at a time, so the rest are added afterwards.
+func (s *SpotifyClient) ReplaceTracks(playlistID string, uris []string) (string, error) {
+	end := batchEnd(0, len(uris))
+
+	resp := new(snapshotResponse)
+	req := map[string]interface{}{
+		"uris": append([]string{}, uris[:end]...),
+	}
+	if _, err := s.put(fmt.Sprintf("/v1/playlists/%s/tracks", playlistID), nil, req, resp); err != nil {
+		return "", errors.Wrap(err, 0)
+	}
+
+	if end == len(uris) {
+		return resp.SnapshotID, nil
+	}
+
+	return s.AddTracks(playlistID, uris[end:])
+}
+
+// UpdatePlaylistDetails changes the details that are set, leaving the others unchanged.
+func (s *SpotifyClient) UpdatePlaylistDetails(playlistID string, details *PlaylistDetails) error {
+	if _, err := s.put(fmt.Sprintf("/v1/playlists/%s", playlistID), nil, details, nil); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// UploadCoverImage replaces a playlist's cover image with a JPEG.
+func (s *SpotifyClient) UploadCoverImage(playlistID string, jpeg []byte) error {
+	body := base64.StdEncoding.EncodeToString(jpeg)
+	if len(body) > maxCoverImageSize {
+		return errors.Errorf("Cover image is %d bytes encoded, more than the %d allowed", len(body), maxCoverImageSize)
+	}
+
+	req, err := s.newRequest(http.MethodPut, fmt.Sprintf("/v1/playlists/%s/images", playlistID), nil, strings.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+
+	glog.Infof("Spotify PUT: %v `<%d byte image>`", req.URL.String(), len(jpeg))
+
+	if _, err := s.do(req, nil); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+func batchEnd(start, length int) int {
+	if end := start + playlistTracksBatchSize; end < length {
+		return end
+	}
+
+	return length
+}
+
 // path may be either a relative ("/foo/bar") or absoluate ("http://example.com/foo/bar").
-// If path is relative then it will be prefixed with spotifyAPIURL.
+// If path is relative then it will be prefixed with spotifyAPIURL. A reqBody that's an io.Reader
+// is sent as is, otherwise it's encoded as JSON.
 func (s *SpotifyClient) newRequest(method, path string, queryParams map[string]string, reqBody interface{}) (*http.Request, error) {
 	u, err := url.Parse(path)
 	if err != nil {
@@ -206,17 +404,23 @@ func (s *SpotifyClient) newRequest(method, path string, queryParams map[string]s
 		return s.newRequest(method, fmt.Sprintf("%s%s", spotifyAPIURL, path), queryParams, reqBody)
 	}
 
+	query := u.Query()
 	for k, v := range queryParams {
-		u.Query().Set(k, v)
+		query.Set(k, v)
 	}
+	u.RawQuery = query.Encode()
 
 	var body io.Reader
-	if reqBody != nil {
+	var contentType string
+	if reader, ok := reqBody.(io.Reader); ok {
+		body = reader
+	} else if reqBody != nil {
 		var buf bytes.Buffer
 		if err := json.NewEncoder(&buf).Encode(reqBody); err != nil {
 			return nil, errors.Wrap(err, 0)
 		}
 		body = &buf
+		contentType = "application/json"
 	}
 
 	req, err := http.NewRequest(method, u.String(), body)
@@ -224,6 +428,9 @@ func (s *SpotifyClient) newRequest(method, path string, queryParams map[string]s
 		return nil, errors.Wrap(err, 0)
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.accessToken))
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
 
 	return req, nil
 }
@@ -241,10 +448,13 @@ func (s *SpotifyClient) get(path string, queryParams map[string]string, optional
 		return nil, errors.Wrap(err, 0)
 	}
 
+	// Optional resources can also exist without the user being allowed to see them
+	if optional && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) {
+		return resp, nil
+	}
+
 	if resp.StatusCode == http.StatusNotFound {
-		if !optional {
-			return nil, &NotFoundError{url: req.URL}
-		}
+		return nil, &NotFoundError{url: req.URL}
 	} else if resp.StatusCode == http.StatusOK {
 		if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
 			return nil, errors.WrapPrefix(err, "Unable to decode body", 0)
@@ -257,46 +467,47 @@ func (s *SpotifyClient) get(path string, queryParams map[string]string, optional
 }
 
 func (s *SpotifyClient) post(path string, reqBody, respData interface{}) (*http.Response, error) {
-	req, err := s.newRequest(http.MethodPost, path, nil, reqBody)
-	if err != nil {
-		return nil, errors.Wrap(err, 0)
-	}
-
-	glog.Infof("Spotify POST: %v `%v`", req.URL.String(), reqBody)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, 0)
-	}
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return nil, errors.Errorf("Unexpected status code %d", resp.StatusCode)
-	}
+	return s.send(http.MethodPost, path, nil, reqBody, respData)
+}
 
-	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(respData); err != nil {
-		return nil, errors.WrapPrefix(err, "Unable to decode response", 0)
-	}
+func (s *SpotifyClient) put(path string, queryParams map[string]string, reqBody, respData interface{}) (*http.Response, error) {
+	return s.send(http.MethodPut, path, queryParams, reqBody, respData)
+}
 
-	return resp, nil
+func (s *SpotifyClient) delete(path string, reqBody, respData interface{}) (*http.Response, error) {
+	return s.send(http.MethodDelete, path, nil, reqBody, respData)
 }
 
-func (s *SpotifyClient) put(path string, queryParams map[string]string, reqBody interface{}) (*http.Response, error) {
-	req, err := s.newRequest(http.MethodPut, path, nil, reqBody)
+// send makes a request that changes something. The response is decoded into respData unless it's nil.
+func (s *SpotifyClient) send(method, path string, queryParams map[string]string, reqBody, respData interface{}) (*http.Response, error) {
+	req, err := s.newRequest(method, path, queryParams, reqBody)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
 
-	glog.Infof("Spotify PUT: %v `%v`", req.URL.String(), reqBody)
+	glog.Infof("Spotify %s: %v `%v`", method, req.URL.String(), reqBody)
 
+	return s.do(req, respData)
+}
+
+func (s *SpotifyClient) do(req *http.Request, respData interface{}) (*http.Response, error) {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, 0)
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+	default:
 		return nil, errors.Errorf("Unexpected status code %d", resp.StatusCode)
 	}
 
+	if respData != nil {
+		if err := json.NewDecoder(resp.Body).Decode(respData); err != nil {
+			return nil, errors.WrapPrefix(err, "Unable to decode response", 0)
+		}
+	}
+
 	return resp, nil
 }
@@ -4,13 +4,34 @@ import (
 	"sort"
 )
 
-// PlaylistTrackIDs returns all track IDs in a playlist, lexically sorted.
-func PlaylistTrackIDs(playlist *Playlist) []string {
-	trackIDs := make([]string, len(playlist.PlaylistTracks))
-	for i, track := range playlist.PlaylistTracks {
-		trackIDs[i] = track.Track.ID
+// TrackKey identifies a playlist entry's track or episode. Local files have no ID, so their URI is used.
+// It's empty if the track is no longer available.
+func TrackKey(track *PlaylistTrack) string {
+	if track.Track == nil {
+		return ""
+	} else if len(track.Track.ID) > 0 {
+		return track.Track.ID
 	}
+
+	return track.Track.URI
+}
+
+// PlaylistTrackIDs returns the keys of all available tracks in a playlist, lexically sorted.
+func PlaylistTrackIDs(playlist *Playlist) []string {
+	trackIDs := OrderedPlaylistTrackIDs(playlist)
 	sort.Strings(trackIDs)
 
 	return trackIDs
 }
+
+// OrderedPlaylistTrackIDs returns the keys of all available tracks in a playlist, in playlist order.
+func OrderedPlaylistTrackIDs(playlist *Playlist) []string {
+	trackIDs := make([]string, 0, len(playlist.PlaylistTracks))
+	for _, track := range playlist.PlaylistTracks {
+		if key := TrackKey(track); len(key) > 0 {
+			trackIDs = append(trackIDs, key)
+		}
+	}
+
+	return trackIDs
+}